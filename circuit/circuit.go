@@ -37,6 +37,16 @@ func (t T) Partition() (fronting T, entropic T, backing T) {
 	return
 }
 
+// Contains reports whether relay r is part of the circuit.
+func (t T) Contains(r *relayentry.T) bool {
+	for _, r0 := range t {
+		if r0 == r || r0.Pubkey.String() == r.Pubkey.String() {
+			return true
+		}
+	}
+	return false
+}
+
 // Join joins a partitioned circuit back.
 func Join(fronting T, entropic T, backing T) (t T) {
 	t = append(t, fronting...)
@@ -45,9 +55,40 @@ func Join(fronting T, entropic T, backing T) (t T) {
 	return
 }
 
+// Options holds the optional parameters of MakeWith.
+type Options struct {
+	// Pick picks a single relay out of a list of candidates. Defaults to a
+	// uniformly random pick.
+	Pick Picker
+	// Skip reports whether a relay must not be used, e.g. because it is
+	// blacklisted or quarantined.
+	Skip func(*relayentry.T) bool
+	// Diversity holds the network diversity rules which the hops of the
+	// circuit must satisfy. No rules are enforced if nil.
+	Diversity *Diversity
+}
+
 // Make attempts to create a viable circuit given a type, number of requested
 // hops and a list of all relays to consider.
-func Make(hops int, all T) (t T, err error) {
+func Make(hops int, all T) (T, error) { return MakeWith(hops, all, Options{}) }
+
+// MakeWith is like Make but allows customizing relay selection via opts.
+func MakeWith(hops int, all T, opts Options) (t T, err error) {
+	pick := opts.Pick
+	if pick == nil {
+		pick = Random
+	}
+
+	if opts.Skip != nil {
+		var ok T
+		for _, r := range all {
+			if !opts.Skip(r) {
+				ok = append(ok, r)
+			}
+		}
+		all = ok
+	}
+
 	have := len(all)
 
 	switch {
@@ -73,29 +114,29 @@ func Make(hops int, all T) (t T, err error) {
 			return
 		}
 
+		// candidates for each hop
+		var hopcands []T
+
 		switch hops {
 		case 1:
-			// one random backing relay
-			t = T{b[rand.Intn(len(b))]}
+			// one backing relay
+			hopcands = []T{b}
 		case 2:
-			// one random fronting and one random backing relay
+			// one fronting and one backing relay
 			if len(f) < 1 {
 				err = fmt.Errorf("cannot construct circuit: no fronting relays")
 				return
 			}
 
-			t = T{f[rand.Intn(len(f))], b[rand.Intn(len(b))]}
+			hopcands = []T{f, b}
 		default:
-			// one random fronting and one random backing relay and however
-			// many random entropic relays
+			// one fronting and one backing relay and however many entropic
+			// relays
 			if len(f) < 1 {
 				err = fmt.Errorf("cannot construct circuit: no fronting relays")
 				return
 			}
 
-			// shuffle entropic relays to break directory order
-			rand.Shuffle(len(e), func(i, j int) { e[i], e[j] = e[j], e[i] })
-
 			// number of entropic relays needed
 			need := hops - 2
 
@@ -109,12 +150,63 @@ func Make(hops int, all T) (t T, err error) {
 				return
 			}
 
-			t = append(t, f[rand.Intn(len(f))])
-			t = append(t, e[:need]...)
-			t = append(t, b[rand.Intn(len(b))])
+			hopcands = append(hopcands, f)
+			for i := 0; i < need; i++ {
+				hopcands = append(hopcands, e)
+			}
+			hopcands = append(hopcands, b)
+		}
+
+		if opts.Diversity == nil {
+			t, err = assemble(pick, hopcands, nil)
 			return
 		}
+
+		// a bad early pick can make later hops impossible, so retry a few
+		// times before giving up
+		d := opts.Diversity.resolver()
+		for i := 0; i < diversityAttempts; i++ {
+			if t, err = assemble(pick, hopcands, d); err == nil {
+				return
+			}
+		}
 	}
 
 	return
 }
+
+// assemble picks one distinct relay out of each list of hop candidates in
+// order, skipping relays which would violate the diversity rules of d if it is
+// not nil.
+func assemble(pick Picker, hopcands []T, d *resolver) (t T, err error) {
+	for _, cands := range hopcands {
+		var (
+			ok   T
+			rule string
+		)
+	outer:
+		for _, r := range cands {
+			for _, r0 := range t {
+				if r0 == r {
+					continue outer
+				}
+				if d != nil {
+					if v := d.violated(r0, r); v != "" {
+						rule = v
+						continue outer
+					}
+				}
+			}
+			ok = append(ok, r)
+		}
+		if len(ok) == 0 {
+			if rule != "" {
+				return nil, &DiversityError{Rule: rule, Role: cands[0].Role}
+			}
+			// should never happen, roles are disjoint and counts checked
+			return nil, fmt.Errorf("cannot construct circuit: no %s relays left", cands[0].Role)
+		}
+		t = append(t, pick(ok))
+	}
+	return
+}
@@ -0,0 +1,57 @@
+package circuit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/M-ERCURY/core/api/jsonb"
+	"github.com/M-ERCURY/core/api/relayentry"
+	"github.com/M-ERCURY/core/api/texturl"
+	"github.com/M-ERCURY/core/mrnet"
+)
+
+func relay(role, addr string) *relayentry.T {
+	return &relayentry.T{
+		Role:    role,
+		Addr:    texturl.URLMustParse("mercury://" + addr),
+		Pubkey:  jsonb.PK(addr),
+		Version: &mrnet.PROTO_VERSION,
+	}
+}
+
+func TestMakeDiversity(t *testing.T) {
+	d := &Diversity{Subnet4: 16, Subnet6: 48, Host: true}
+	for _, tc := range []struct {
+		name string
+		all  T
+		rule string
+	}{
+		{"ok v4", T{relay("fronting", "10.0.1.1:443"), relay("backing", "10.0.2.2:443"), relay("backing", "10.1.0.1:443")}, ""},
+		{"ok v6", T{relay("fronting", "[2001:db8::1]:443"), relay("backing", "[2001:db8::2]:443"), relay("backing", "[2001:db9::1]:443")}, ""},
+		{"subnet4", T{relay("fronting", "10.0.1.1:443"), relay("backing", "10.0.2.2:443")}, "subnet4 /16"},
+		{"subnet6", T{relay("fronting", "[2001:db8::1]:443"), relay("backing", "[2001:db8:0:1::1]:443")}, "subnet6 /48"},
+		{"host", T{relay("fronting", "10.0.1.1:443"), relay("backing", "10.0.1.1:444")}, "host"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 16; i++ {
+				c, err := MakeWith(2, tc.all, Options{Diversity: d})
+				if tc.rule == "" {
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(c) != 2 || c[0] != tc.all[0] || c[1] != tc.all[2] {
+						t.Fatalf("unexpected circuit %v", c)
+					}
+					continue
+				}
+				var e *DiversityError
+				if !errors.As(err, &e) {
+					t.Fatalf("expected diversity error, got %v", err)
+				}
+				if e.Rule != tc.rule || e.Role != "backing" {
+					t.Fatalf("expected %s rule failure for backing relay, got %s", tc.rule, e)
+				}
+			}
+		})
+	}
+}
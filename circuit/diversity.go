@@ -0,0 +1,118 @@
+package circuit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/M-ERCURY/core/api/relayentry"
+)
+
+// number of attempts at assembling a circuit satisfying diversity rules
+const diversityAttempts = 8
+
+// Diversity describes the network diversity rules that every pair of hops in
+// a circuit must satisfy.
+type Diversity struct {
+	// Subnet4 is the length of the IPv4 prefix no two hops may share; 0
+	// disables the rule.
+	Subnet4 int
+	// Subnet6 is the length of the IPv6 prefix no two hops may share; 0
+	// disables the rule.
+	Subnet6 int
+	// Host forbids two hops sharing a hostname or a resolved address.
+	Host bool
+	// Lookup resolves relay hostnames. Defaults to net.LookupHost.
+	Lookup func(host string) ([]string, error)
+}
+
+// DiversityError is returned by MakeWith when no circuit satisfying the
+// diversity rules could be constructed.
+type DiversityError struct {
+	// Rule describes the rule which could not be satisfied, e.g. "subnet4
+	// /16".
+	Rule string
+	// Role is the role of the hop which could not be picked.
+	Role string
+}
+
+func (e *DiversityError) Error() string {
+	return fmt.Sprintf(
+		"cannot construct circuit: diversity rule %s failed: every %s relay left conflicts with another hop",
+		e.Rule,
+		e.Role,
+	)
+}
+
+// resolver applies diversity rules while caching resolved relay addresses for
+// a single MakeWith call.
+type resolver struct {
+	*Diversity
+	ips map[*relayentry.T][]net.IP
+}
+
+func (d *Diversity) resolver() *resolver {
+	return &resolver{Diversity: d, ips: map[*relayentry.T][]net.IP{}}
+}
+
+// addrs returns the resolved addresses of relay r. Resolution errors are not
+// fatal; only the remaining rules apply to relays which cannot be resolved.
+func (d *resolver) addrs(r *relayentry.T) []net.IP {
+	if ips, ok := d.ips[r]; ok {
+		return ips
+	}
+	var ips []net.IP
+	host := r.Addr.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		lookup := d.Lookup
+		if lookup == nil {
+			lookup = net.LookupHost
+		}
+		addrs, _ := lookup(host)
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	d.ips[r] = ips
+	return ips
+}
+
+// violated describes the first rule relays a and b violate when used in the
+// same circuit or returns "" if they don't violate any.
+func (d *resolver) violated(a, b *relayentry.T) string {
+	if d.Host && strings.EqualFold(a.Addr.Hostname(), b.Addr.Hostname()) {
+		return "host"
+	}
+	if !d.Host && d.Subnet4 == 0 && d.Subnet6 == 0 {
+		return ""
+	}
+	for _, ipa := range d.addrs(a) {
+		for _, ipb := range d.addrs(b) {
+			if d.Host && ipa.Equal(ipb) {
+				return "host"
+			}
+			a4, b4 := ipa.To4(), ipb.To4()
+			switch {
+			case a4 != nil && b4 != nil:
+				if d.Subnet4 > 0 && samenet(a4, b4, d.Subnet4, 32) {
+					return fmt.Sprintf("subnet4 /%d", d.Subnet4)
+				}
+			case a4 == nil && b4 == nil:
+				if d.Subnet6 > 0 && samenet(ipa, ipb, d.Subnet6, 128) {
+					return fmt.Sprintf("subnet6 /%d", d.Subnet6)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// samenet reports whether a and b share the same prefix of length ones.
+func samenet(a, b net.IP, ones, bits int) bool {
+	m := net.CIDRMask(ones, bits)
+	return a.Mask(m).Equal(b.Mask(m))
+}
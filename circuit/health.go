@@ -0,0 +1,123 @@
+package circuit
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/M-ERCURY/core/api/relayentry"
+)
+
+const (
+	// quarantine period after the first failure, doubled on each subsequent
+	// failure up to quarantineMax
+	quarantineBase = 30 * time.Second
+	quarantineMax  = time.Hour
+	// failure counts are reset after this long without failures
+	forgetAfter = 6 * time.Hour
+)
+
+// HealthEntry is the failure record of a single relay.
+type HealthEntry struct {
+	// Failures is the number of consecutive failures.
+	Failures int `json:"failures"`
+	// LastError is the description of the last failure.
+	LastError string `json:"last_error,omitempty"`
+	// LastFailure is the unix timestamp of the last failure.
+	LastFailure int64 `json:"last_failure"`
+	// Until is the unix timestamp at which the quarantine ends.
+	Until int64 `json:"quarantined_until"`
+}
+
+// Quarantined reports whether the relay is quarantined at time t.
+func (e HealthEntry) Quarantined(t time.Time) bool { return t.Unix() < e.Until }
+
+// Health tracks relay failures keyed by relay public key and quarantines
+// failing relays for an exponentially increasing backoff period. It is safe
+// for concurrent use and can be (un)marshaled to persist the state.
+type Health struct {
+	mu sync.Mutex
+	m  map[string]*HealthEntry
+}
+
+// NewHealth creates an empty Health.
+func NewHealth() *Health { return &Health{m: map[string]*HealthEntry{}} }
+
+// Fail records a failure of relay r and (re)quarantines it.
+func (h *Health) Fail(r *relayentry.T, err error) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.m[r.Pubkey.String()]
+	if e == nil || now.Sub(time.Unix(e.LastFailure, 0)) > forgetAfter {
+		e = &HealthEntry{}
+		h.m[r.Pubkey.String()] = e
+	}
+	e.Failures++
+	e.LastFailure = now.Unix()
+	if err != nil {
+		e.LastError = err.Error()
+	}
+	d := quarantineBase
+	for i := 1; i < e.Failures && d < quarantineMax; i++ {
+		d *= 2
+	}
+	if d > quarantineMax {
+		d = quarantineMax
+	}
+	e.Until = now.Add(d).Unix()
+}
+
+// Quarantined reports whether relay r is currently quarantined.
+func (h *Health) Quarantined(r *relayentry.T) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.m[r.Pubkey.String()]
+	return e != nil && e.Quarantined(time.Now())
+}
+
+// LeastRecentlyFailed returns the relays of rs which are currently
+// quarantined, least recently failed first.
+func (h *Health) LeastRecentlyFailed(rs T) (q T) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range rs {
+		if e := h.m[r.Pubkey.String()]; e != nil && e.Quarantined(now) {
+			q = append(q, r)
+		}
+	}
+	sort.SliceStable(q, func(i, j int) bool {
+		return h.m[q[i].Pubkey.String()].LastFailure < h.m[q[j].Pubkey.String()].LastFailure
+	})
+	return
+}
+
+// Entries returns a copy of all failure records keyed by relay public key.
+func (h *Health) Entries() map[string]HealthEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := make(map[string]HealthEntry, len(h.m))
+	for k, v := range h.m {
+		r[k] = *v
+	}
+	return r
+}
+
+func (h *Health) MarshalJSON() ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return json.Marshal(h.m)
+}
+
+func (h *Health) UnmarshalJSON(b []byte) error {
+	m := map[string]*HealthEntry{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.m = m
+	h.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,23 @@
+package circuit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeastRecentlyFailed(t *testing.T) {
+	h := NewHealth()
+	a, b, c := relay("backing", "10.0.0.1:443"), relay("backing", "10.0.0.2:443"), relay("backing", "10.0.0.3:443")
+	h.Fail(b, errors.New("b"))
+	h.Fail(a, errors.New("a"))
+	// a failed later than b
+	h.m[b.Pubkey.String()].LastFailure -= 10
+	// c's quarantine is over
+	h.Fail(c, errors.New("c"))
+	h.m[c.Pubkey.String()].Until = time.Now().Add(-time.Second).Unix()
+	q := h.LeastRecentlyFailed(T{a, b, c})
+	if len(q) != 2 || q[0] != b || q[1] != a {
+		t.Fatalf("got %v, expected the quarantined relays least recently failed first", q)
+	}
+}
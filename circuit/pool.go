@@ -0,0 +1,490 @@
+package circuit
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/M-ERCURY/core/api/relayentry"
+)
+
+// Circuit pool policies.
+const (
+	// PoolRoundRobin hands out ready circuits in turn.
+	PoolRoundRobin = "round_robin"
+	// PoolRandom hands out a random ready circuit.
+	PoolRandom = "random"
+	// PoolFastest hands out the ready circuit with the lowest measured RTT.
+	PoolFastest = "fastest"
+)
+
+const (
+	// backoff between failed background builds
+	poolBackoffMin = time.Second
+	poolBackoffMax = 30 * time.Second
+	// isolated circuits unused for this long are forgotten
+	isolatedIdle = 10 * time.Minute
+)
+
+// ErrPoolClosed is returned by Get once the pool is closed.
+var ErrPoolClosed = errors.New("circuit pool closed")
+
+// PoolOptions holds the parameters of a Pool.
+type PoolOptions struct {
+	// Size is the number of ready circuits to keep built.
+	Size int
+	// Policy is how ready circuits are handed out, PoolRoundRobin by default.
+	Policy string
+	// Stats are the relay measurements used by the PoolFastest policy.
+	Stats *Stats
+	// MaxAge is the age after which a circuit is rotated, 0 for no limit.
+	MaxAge time.Duration
+	// MaxStreams is the number of streams after which a circuit is rotated,
+	// 0 for no limit.
+	MaxStreams int
+	// Changed, if not nil, is called after the circuits returned by Circuits
+	// changed, from a goroutine of its own; calls for changes in quick
+	// succession may be coalesced.
+	Changed func()
+}
+
+// entry is a circuit in the pool.
+type entry struct {
+	t       T
+	born    time.Time
+	streams int
+	// streams not ended yet
+	open    int
+	retired bool
+	// last use, only tracked for isolated circuits
+	used time.Time
+}
+
+// Pool keeps a number of ready circuits built in the background and hands them
+// out by policy. Failed circuits are dropped and replaced asynchronously.
+// Circuits handed out for an isolation key are taken out of the shared set and
+// dedicated to that key.
+//
+// Circuits exceeding their maximum age or number of streams are rotated: new
+// streams go to a fresh circuit as soon as one is ready, while existing
+// streams are left to finish on the old one. Circuits no longer handed out
+// are kept draining until Done was called for each of their streams.
+type Pool struct {
+	PoolOptions
+	build func(exclude T) (T, error)
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	ready []*entry
+	next  int
+	iso   map[string]*entry
+	// circuits no longer handed out with open streams
+	draining []*entry
+	// last build error and number of finished build attempts
+	err    error
+	gen    int
+	wake   chan struct{}
+	change chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+// NewPool creates a pool of circuits built by build and starts warming it up
+// in the background. Circuits returned by build must not contain any of the
+// relays in exclude.
+func NewPool(opts PoolOptions, build func(exclude T) (T, error)) (*Pool, error) {
+	switch opts.Policy {
+	case "":
+		opts.Policy = PoolRoundRobin
+	case PoolRoundRobin, PoolRandom:
+	case PoolFastest:
+		if opts.Stats == nil {
+			return nil, fmt.Errorf("circuit pool policy %s requires relay stats", opts.Policy)
+		}
+	default:
+		return nil, fmt.Errorf("unknown circuit pool policy: %s", opts.Policy)
+	}
+	if opts.Size < 1 {
+		opts.Size = 1
+	}
+	p := &Pool{
+		PoolOptions: opts,
+		build:       build,
+		wake:        make(chan struct{}, 1),
+		change:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		iso:         map[string]*entry{},
+	}
+	p.cond = sync.NewCond(&p.mu)
+	go p.run()
+	if opts.Changed != nil {
+		go p.notify()
+	}
+	p.wakeup()
+	return p, nil
+}
+
+// wakeup nudges the background builder without blocking.
+func (p *Pool) wakeup() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// expired reports whether e needs to be rotated at time now.
+func (p *Pool) expired(e *entry, now time.Time) bool {
+	return e.retired ||
+		(p.MaxAge > 0 && now.Sub(e.born) > p.MaxAge) ||
+		(p.MaxStreams > 0 && e.streams >= p.MaxStreams)
+}
+
+// fresh returns the ready circuits which don't need to be rotated.
+func (p *Pool) fresh(now time.Time) (r []*entry) {
+	for _, e := range p.ready {
+		if !p.expired(e, now) {
+			r = append(r, e)
+		}
+	}
+	return
+}
+
+// changed schedules a call to Changed without blocking.
+func (p *Pool) changed() {
+	select {
+	case p.change <- struct{}{}:
+	default:
+	}
+}
+
+// notify calls Changed after changes until the pool is closed.
+func (p *Pool) notify() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.change:
+			p.Changed()
+		}
+	}
+}
+
+// drain keeps the entries with open streams draining.
+func (p *Pool) drain(es ...*entry) {
+	for _, e := range es {
+		if e.open > 0 {
+			p.draining = append(p.draining, e)
+		}
+	}
+}
+
+// run builds circuits until the pool is full of fresh circuits, then waits to
+// be woken up.
+func (p *Pool) run() {
+	backoff := poolBackoffMin
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.wake:
+		}
+		for {
+			p.mu.Lock()
+			full := len(p.fresh(time.Now())) >= p.Size
+			p.mu.Unlock()
+			if full {
+				break
+			}
+			t, err := p.build(nil)
+			p.mu.Lock()
+			p.gen++
+			p.err = err
+			if err == nil {
+				p.ready = append(p.ready, &entry{t: t, born: time.Now()})
+				p.changed()
+			}
+			p.cond.Broadcast()
+			p.mu.Unlock()
+			if err == nil {
+				backoff = poolBackoffMin
+				continue
+			}
+			log.Printf("could not build circuit: %s, retrying in %s", err, backoff)
+			select {
+			case <-p.done:
+				return
+			case <-p.wake:
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > poolBackoffMax {
+				backoff = poolBackoffMax
+			}
+		}
+	}
+}
+
+// Get returns a circuit for the isolation key. An empty key returns a shared
+// ready circuit; any other key returns the circuit dedicated to it, dedicating
+// a ready circuit to the key if there is none yet. If no circuits are ready,
+// Get waits for the next build attempt and returns its error if it fails.
+func (p *Pool) Get(key string) (T, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	now := time.Now()
+	// rotate expired circuits once fresh ones are available
+	if fresh := p.fresh(now); len(fresh) > 0 && len(fresh) < len(p.ready) {
+		for _, e := range p.ready {
+			if p.expired(e, now) {
+				p.drain(e)
+			}
+		}
+		p.ready = fresh
+		p.changed()
+	}
+	if len(p.ready) < p.Size || len(p.fresh(now)) < len(p.ready) {
+		p.wakeup()
+	}
+	if key != "" {
+		if e := p.iso[key]; e != nil && (!p.expired(e, now) || len(p.fresh(now)) == 0) {
+			e.used = now
+			e.streams++
+			e.open++
+			return e.t, nil
+		}
+	}
+	gen := p.gen
+	for len(p.ready) == 0 {
+		if p.closed {
+			return nil, ErrPoolClosed
+		}
+		if p.gen != gen && p.err != nil {
+			return nil, p.err
+		}
+		p.wakeup()
+		p.cond.Wait()
+	}
+	var i int
+	switch p.Policy {
+	case PoolRoundRobin:
+		i = p.next % len(p.ready)
+		p.next++
+	case PoolRandom:
+		i = rand.Intn(len(p.ready))
+	case PoolFastest:
+		i = p.fastest()
+	}
+	e := p.ready[i]
+	e.streams++
+	e.open++
+	if key != "" {
+		// dedicate to key & replace
+		p.ready = append(p.ready[:i:i], p.ready[i+1:]...)
+		for k, v := range p.iso {
+			if now.Sub(v.used) > isolatedIdle {
+				p.drain(v)
+				delete(p.iso, k)
+			}
+		}
+		if e0 := p.iso[key]; e0 != nil {
+			p.drain(e0)
+		}
+		e.used = now
+		p.iso[key] = e
+		p.changed()
+		p.wakeup()
+	}
+	return e.t, nil
+}
+
+// fastest returns the index of the ready circuit with the lowest sum of
+// measured relay RTTs. Circuits with unmeasured relays are considered last.
+func (p *Pool) fastest() (best int) {
+	var min float64
+	for i, e := range p.ready {
+		var sum float64
+		for _, r := range e.t {
+			m, ok := p.Stats.Get(r)
+			if !ok || m.RTT == 0 {
+				sum = -1
+				break
+			}
+			sum += m.RTT
+		}
+		if sum >= 0 && (min == 0 || sum < min) {
+			best, min = i, sum
+		}
+	}
+	return
+}
+
+// Drop removes every circuit which contains relay r and replaces them in the
+// background.
+func (p *Pool) Drop(r *relayentry.T) {
+	p.mu.Lock()
+	var keep []*entry
+	for _, e := range p.ready {
+		if !e.t.Contains(r) {
+			keep = append(keep, e)
+		} else {
+			p.drain(e)
+		}
+	}
+	p.ready = keep
+	for k, v := range p.iso {
+		if v.t.Contains(r) {
+			p.drain(v)
+			delete(p.iso, k)
+		}
+	}
+	p.changed()
+	p.mu.Unlock()
+	p.wakeup()
+}
+
+// Replace synchronously builds a fresh circuit without the relays in exclude
+// and hands it out for the isolation key in place of the circuit Get returned.
+// A circuit built for a non-empty key is dedicated to that key; otherwise it
+// joins the shared set if there is room.
+func (p *Pool) Replace(key string, exclude T) (T, error) {
+	t, err := p.build(exclude)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	e := &entry{t: t, born: now, streams: 1, open: 1, used: now}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.closed:
+	case key != "":
+		if e0 := p.iso[key]; e0 != nil {
+			p.drain(e0)
+		}
+		p.iso[key] = e
+	case len(p.fresh(now)) < p.Size:
+		p.ready = append(p.ready, e)
+		p.cond.Broadcast()
+	default:
+		p.drain(e)
+	}
+	p.changed()
+	return t, nil
+}
+
+// Reset removes all circuits and rebuilds them in the background.
+func (p *Pool) Reset() {
+	p.mu.Lock()
+	p.drain(p.ready...)
+	for _, e := range p.iso {
+		p.drain(e)
+	}
+	p.ready = nil
+	p.iso = map[string]*entry{}
+	p.changed()
+	p.mu.Unlock()
+	p.wakeup()
+}
+
+// Done ends a stream on circuit t, as returned by Get or Replace. Draining
+// circuits are forgotten once their last stream ends.
+func (p *Pool) Done(t T) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, e := range p.draining {
+		if same(e.t, t) {
+			if e.open--; e.open <= 0 {
+				p.draining = append(p.draining[:i:i], p.draining[i+1:]...)
+				p.changed()
+			}
+			return
+		}
+	}
+	for _, e := range p.ready {
+		if same(e.t, t) {
+			e.open--
+			return
+		}
+	}
+	for _, e := range p.iso {
+		if same(e.t, t) {
+			e.open--
+			return
+		}
+	}
+}
+
+// same reports whether a and b are the same circuit, not merely one of the
+// same relays: circuits are handed out sharing their entry's backing array.
+func same(a, b T) bool {
+	return len(a) > 0 && len(a) == len(b) && &a[0] == &b[0]
+}
+
+// SetRotation changes the maximum age and number of streams of circuits.
+func (p *Pool) SetRotation(maxAge time.Duration, maxStreams int) {
+	p.mu.Lock()
+	p.MaxAge, p.MaxStreams = maxAge, maxStreams
+	p.mu.Unlock()
+	p.wakeup()
+}
+
+// Rotate retires all circuits. New streams go to fresh circuits as soon as
+// they are built, while existing streams finish on the retired ones.
+func (p *Pool) Rotate() {
+	p.mu.Lock()
+	for _, e := range p.ready {
+		e.retired = true
+	}
+	for _, e := range p.iso {
+		e.retired = true
+	}
+	p.mu.Unlock()
+	p.wakeup()
+}
+
+// Close stops building circuits and fails pending and future calls to Get.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.ready, p.iso, p.draining = nil, map[string]*entry{}, nil
+	close(p.done)
+	p.cond.Broadcast()
+}
+
+// Circuits returns the currently ready, isolated and draining circuits.
+func (p *Pool) Circuits() []T {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var r []T
+	for _, e := range p.ready {
+		r = append(r, e.t)
+	}
+	for _, e := range p.iso {
+		r = append(r, e.t)
+	}
+	for _, e := range p.draining {
+		r = append(r, e.t)
+	}
+	return r
+}
+
+// Relays returns all relays used by the circuits currently in the pool.
+func (p *Pool) Relays() (all T) {
+	for _, t := range p.Circuits() {
+		for _, r := range t {
+			if !all.Contains(r) {
+				all = append(all, r)
+			}
+		}
+	}
+	return
+}
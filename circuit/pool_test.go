@@ -0,0 +1,267 @@
+package circuit
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// builder builds single-hop circuits of new relays, failing with err if set.
+type builder struct {
+	mu      sync.Mutex
+	n       int
+	err     error
+	exclude []T
+}
+
+func (b *builder) build(exclude T) (T, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.n++
+	b.exclude = append(b.exclude, exclude)
+	if b.err != nil {
+		return nil, b.err
+	}
+	return T{relay("backing", fmt.Sprintf("10.0.%d.1:443", b.n))}, nil
+}
+
+func (b *builder) set(err error) {
+	b.mu.Lock()
+	b.err = err
+	b.mu.Unlock()
+}
+
+func (b *builder) builds() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
+
+// newPool returns a pool of circuits built by b, once it is full.
+func newPool(t *testing.T, opts PoolOptions, b *builder) *Pool {
+	p, err := NewPool(opts, b.build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	waitFor(t, "a full pool", func() bool { return len(p.Circuits()) >= p.Size })
+	return p
+}
+
+// waitFor waits up to a second for cond to hold.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func get(t *testing.T, p *Pool, key string) T {
+	t.Helper()
+	c, err := p.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPoolShared(t *testing.T) {
+	p := newPool(t, PoolOptions{Size: 2}, &builder{})
+	a, b := get(t, p, ""), get(t, p, "")
+	if a[0] == b[0] {
+		t.Fatal("round robin handed out the same circuit twice")
+	}
+	if c := get(t, p, ""); c[0] != a[0] {
+		t.Fatalf("got %v, expected round robin back to %v", c, a)
+	}
+}
+
+func TestPoolIsolated(t *testing.T) {
+	p := newPool(t, PoolOptions{Size: 2}, &builder{})
+	a := get(t, p, "a")
+	if c := get(t, p, "a"); c[0] != a[0] {
+		t.Fatalf("got %v for the same key, expected %v", c, a)
+	}
+	b := get(t, p, "b")
+	if b[0] == a[0] {
+		t.Fatal("two keys share a circuit")
+	}
+	// dedicated circuits are replaced in the shared set
+	waitFor(t, "replacement circuits", func() bool { return len(p.Circuits()) == 4 })
+	for i := 0; i < 4; i++ {
+		if c := get(t, p, ""); c[0] == a[0] || c[0] == b[0] {
+			t.Fatalf("shared circuit %v is dedicated to a key", c)
+		}
+	}
+}
+
+func TestPoolBuildError(t *testing.T) {
+	b := &builder{err: errors.New("no relays")}
+	p, err := NewPool(PoolOptions{}, b.build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err = p.Get(""); err == nil || err.Error() != "no relays" {
+		t.Fatalf("got %v, expected the build error", err)
+	}
+	// failed builds are retried with backoff, not in a loop
+	n := b.builds()
+	time.Sleep(poolBackoffMin / 2)
+	if m := b.builds(); m > n+1 {
+		t.Fatalf("%d builds in %s, expected backoff", m-n, poolBackoffMin/2)
+	}
+	b.set(nil)
+	if _, err = p.Get(""); err != nil {
+		t.Fatalf("got %v, expected a circuit once builds succeed", err)
+	}
+}
+
+func TestPoolReplace(t *testing.T) {
+	b := &builder{}
+	p := newPool(t, PoolOptions{Size: 1}, b)
+	a := get(t, p, "a")
+	c, err := p.Replace("a", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	exclude := b.exclude[len(b.exclude)-1]
+	b.mu.Unlock()
+	if len(exclude) != 1 || exclude[0] != a[0] {
+		t.Fatalf("got exclude %v, expected %v", exclude, a)
+	}
+	if d := get(t, p, "a"); d[0] != c[0] {
+		t.Fatalf("got %v, expected the replacement %v", d, c)
+	}
+}
+
+func TestPoolDrop(t *testing.T) {
+	p := newPool(t, PoolOptions{Size: 2}, &builder{})
+	a := get(t, p, "")
+	p.Done(a)
+	p.Drop(a[0])
+	for _, c := range p.Circuits() {
+		if c.Contains(a[0]) {
+			t.Fatalf("dropped relay still in %v", c)
+		}
+	}
+	waitFor(t, "a replacement circuit", func() bool { return len(p.Circuits()) == 2 })
+}
+
+func TestPoolClose(t *testing.T) {
+	// the first build never finishes
+	release := make(chan struct{})
+	defer close(release)
+	p, err := NewPool(PoolOptions{}, func(T) (T, error) {
+		<-release
+		return nil, errors.New("no relays")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(chan error)
+	go func() {
+		_, err := p.Get("")
+		res <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Close()
+	if err = <-res; err != ErrPoolClosed {
+		t.Fatalf("pending Get: got %v, expected %v", err, ErrPoolClosed)
+	}
+	if _, err = p.Get(""); err != ErrPoolClosed {
+		t.Fatalf("got %v, expected %v", err, ErrPoolClosed)
+	}
+}
+
+// rotated waits for p to hand out a circuit other than a and returns it.
+func rotated(t *testing.T, p *Pool, a T) (c T) {
+	t.Helper()
+	waitFor(t, "a fresh circuit", func() bool {
+		if c = get(t, p, ""); c[0] != a[0] {
+			return true
+		}
+		p.Done(c)
+		return false
+	})
+	return
+}
+
+// draining reports whether p keeps circuit a.
+func draining(p *Pool, a T) bool {
+	for _, c := range p.Circuits() {
+		if same(c, a) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPoolRotation(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		opts   PoolOptions
+		rotate func(p *Pool)
+	}{
+		{"max_age", PoolOptions{Size: 1, MaxAge: 50 * time.Millisecond}, func(p *Pool) { time.Sleep(60 * time.Millisecond) }},
+		{"max_streams", PoolOptions{Size: 1, MaxStreams: 2}, func(p *Pool) { p.Done(get(t, p, "")) }},
+		{"set_rotation", PoolOptions{Size: 1}, func(p *Pool) { p.SetRotation(0, 1) }},
+		{"rotate", PoolOptions{Size: 1}, func(p *Pool) { p.Rotate() }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newPool(t, tc.opts, &builder{})
+			// a stream left open on the first circuit
+			a := get(t, p, "")
+			tc.rotate(p)
+			p.Done(rotated(t, p, a))
+			if !draining(p, a) {
+				t.Fatal("rotated circuit dropped with a stream open")
+			}
+			p.Done(a)
+			if draining(p, a) {
+				t.Fatal("rotated circuit kept after its last stream")
+			}
+		})
+	}
+}
+
+func TestPoolDrain(t *testing.T) {
+	p := newPool(t, PoolOptions{Size: 2}, &builder{})
+	a, b := get(t, p, ""), get(t, p, "key")
+	if same(a, b) {
+		t.Fatal("expected distinct shared and dedicated circuits")
+	}
+	p.Reset()
+	if !draining(p, a) || !draining(p, b) {
+		t.Fatal("reset circuits dropped with streams open")
+	}
+	p.Done(b)
+	p.Drop(a[0])
+	if !draining(p, a) || draining(p, b) {
+		t.Fatal("wrong circuits draining")
+	}
+}
+
+func TestPoolChanged(t *testing.T) {
+	changed := make(chan struct{}, 1)
+	p := newPool(t, PoolOptions{Size: 1, Changed: func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}}, &builder{})
+	<-changed
+	a := get(t, p, "")
+	p.Done(a)
+	p.Drop(a[0])
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("no change reported after a drop")
+	}
+}
@@ -0,0 +1,218 @@
+package circuit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/M-ERCURY/core/api/relayentry"
+)
+
+// Relay selection policies.
+const (
+	// SelectRandom picks relays uniformly at random.
+	SelectRandom = "random"
+	// SelectWeighted picks relays at random, weighted by measured handshake
+	// RTT and throughput.
+	SelectWeighted = "weighted"
+)
+
+const (
+	// measurements older than this are considered unknown
+	staleAfter = 24 * time.Hour
+	// weight of a new sample in the moving averages
+	ewmaAlpha = 0.3
+	// minimum relative weight of a relay so every relay keeps a chance
+	minWeight = 0.05
+)
+
+// Picker picks a single relay out of a non-empty list of candidates.
+type Picker func(T) *relayentry.T
+
+// Random picks a relay uniformly at random.
+func Random(rs T) *relayentry.T { return rs[rand.Intn(len(rs))] }
+
+// NewPicker returns the Picker for the given selection policy. An empty policy
+// is the same as SelectRandom.
+func NewPicker(policy string, s *Stats) (Picker, error) {
+	switch policy {
+	case "", SelectRandom:
+		return Random, nil
+	case SelectWeighted:
+		return s.Weighted, nil
+	default:
+		return nil, fmt.Errorf("unknown relay selection policy: %s", policy)
+	}
+}
+
+// Measurement holds the measured performance of a single relay.
+type Measurement struct {
+	// RTT is the moving average of the handshake round-trip time in
+	// milliseconds.
+	RTT float64 `json:"rtt_ms,omitempty"`
+	// Throughput is the moving average of splice throughput in bytes/s.
+	Throughput float64 `json:"throughput,omitempty"`
+	// Updated is the unix timestamp of the last sample.
+	Updated int64 `json:"updated"`
+}
+
+// Stats keeps relay measurements keyed by relay public key. It is safe for
+// concurrent use and can be (un)marshaled to persist measurements.
+type Stats struct {
+	mu sync.Mutex
+	m  map[string]*Measurement
+}
+
+// NewStats creates an empty Stats.
+func NewStats() *Stats { return &Stats{m: map[string]*Measurement{}} }
+
+func ewma(old, sample float64) float64 {
+	if old == 0 {
+		return sample
+	}
+	return old*(1-ewmaAlpha) + sample*ewmaAlpha
+}
+
+func (s *Stats) get(pk string) *Measurement {
+	m := s.m[pk]
+	if m == nil || time.Since(time.Unix(m.Updated, 0)) > staleAfter {
+		m = &Measurement{}
+		s.m[pk] = m
+	}
+	return m
+}
+
+// ObserveRTT records a handshake round-trip time sample for relay r.
+func (s *Stats) ObserveRTT(r *relayentry.T, rtt time.Duration) {
+	s.mu.Lock()
+	m := s.get(r.Pubkey.String())
+	m.RTT = ewma(m.RTT, float64(rtt)/float64(time.Millisecond))
+	m.Updated = time.Now().Unix()
+	s.mu.Unlock()
+}
+
+// ObserveTransfer records n bytes transferred over d through relay r.
+func (s *Stats) ObserveTransfer(r *relayentry.T, n int64, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	s.mu.Lock()
+	m := s.get(r.Pubkey.String())
+	m.Throughput = ewma(m.Throughput, float64(n)/d.Seconds())
+	m.Updated = time.Now().Unix()
+	s.mu.Unlock()
+}
+
+// Get returns the current measurement of relay r, if any.
+func (s *Stats) Get(r *relayentry.T) (m Measurement, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m0 := s.m[r.Pubkey.String()]
+	if m0 == nil || time.Since(time.Unix(m0.Updated, 0)) > staleAfter {
+		return
+	}
+	return *m0, true
+}
+
+// Probe measures the TCP handshake RTT of every relay in rs concurrently,
+// giving up on each after timeout.
+func (s *Stats) Probe(rs T, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, r := range rs {
+		wg.Add(1)
+		go func(r *relayentry.T) {
+			defer wg.Done()
+			port := r.Addr.Port()
+			if port == "" {
+				port = "443"
+			}
+			t0 := time.Now()
+			c, err := net.DialTimeout("tcp", net.JoinHostPort(r.Addr.Hostname(), port), timeout)
+			if err != nil {
+				return
+			}
+			s.ObserveRTT(r, time.Since(t0))
+			c.Close()
+		}(r)
+	}
+	wg.Wait()
+}
+
+// median returns the median of the non-zero values in xs or 0 if there are
+// none.
+func median(xs []float64) float64 {
+	var nz []float64
+	for _, x := range xs {
+		if x > 0 {
+			nz = append(nz, x)
+		}
+	}
+	if len(nz) == 0 {
+		return 0
+	}
+	sort.Float64s(nz)
+	return nz[len(nz)/2]
+}
+
+// Weighted picks a relay at random with a probability proportional to its
+// measured speed: inversely to its RTT and proportionally to its throughput.
+// Unmeasured relays are weighted as the median relay so they still get picked
+// and measured.
+func (s *Stats) Weighted(rs T) *relayentry.T {
+	rtts, tps := make([]float64, len(rs)), make([]float64, len(rs))
+	s.mu.Lock()
+	for i, r := range rs {
+		if m := s.m[r.Pubkey.String()]; m != nil && time.Since(time.Unix(m.Updated, 0)) <= staleAfter {
+			rtts[i], tps[i] = m.RTT, m.Throughput
+		}
+	}
+	s.mu.Unlock()
+	mrtt, mtp := median(rtts), median(tps)
+	var (
+		ws    = make([]float64, len(rs))
+		total float64
+	)
+	for i := range rs {
+		w := 1.0
+		if rtts[i] > 0 {
+			w *= mrtt / rtts[i]
+		}
+		if tps[i] > 0 {
+			w *= tps[i] / mtp
+		}
+		if w < minWeight {
+			w = minWeight
+		}
+		ws[i] = w
+		total += w
+	}
+	x := rand.Float64() * total
+	for i, w := range ws {
+		if x < w {
+			return rs[i]
+		}
+		x -= w
+	}
+	return rs[len(rs)-1]
+}
+
+func (s *Stats) MarshalJSON() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Marshal(s.m)
+}
+
+func (s *Stats) UnmarshalJSON(b []byte) error {
+	m := map[string]*Measurement{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.m = m
+	s.mu.Unlock()
+	return nil
+}
@@ -22,6 +22,13 @@ type C struct {
 	Circuit Circuit `json:"circuit,omitempty"`
 	// Address describes the listening addresses and ports.
 	Address Address `json:"address,omitempty"`
+	// ACL restricts the clients and targets of the local listeners.
+	ACL ACL `json:"acl,omitempty"`
+	// DNS describes how mercury_tun handles the name lookups of its clients.
+	DNS DNS `json:"dns,omitempty"`
+	// Split selects the mercury_tun traffic which goes direct instead of
+	// through mercury.
+	Split Split `json:"split,omitempty"`
 
 	PofURL string `json:"pof_url,omitempty"`
 }
@@ -37,18 +44,125 @@ type Accesskey struct {
 type Circuit struct {
 	// Whitelist is the optional user-defined list of relays to use exclusively.
 	Whitelist *[]string `json:"whitelist,omitempty"`
+	// Blacklist is the optional user-defined list of relays to never use.
+	Blacklist *[]string `json:"blacklist,omitempty"`
 	// Hops is the desired number of hops to use for the circuit.
 	Hops int `json:"hops,omitempty"`
+	// Selection is the relay selection policy, "random" or "weighted".
+	Selection string `json:"selection,omitempty"`
+	// PoolSize is the number of ready circuits to keep built.
+	PoolSize int `json:"pool_size,omitempty"`
+	// PoolPolicy is how ready circuits are handed out, "round_robin",
+	// "random" or "fastest".
+	PoolPolicy string `json:"pool_policy,omitempty"`
+	// MaxAge is the age after which a circuit is rotated, 0 for no limit.
+	MaxAge duration.T `json:"max_age"`
+	// MaxStreams is the number of streams after which a circuit is rotated,
+	// 0 for no limit.
+	MaxStreams int `json:"max_streams"`
+	// DialAttempts is the number of circuits tried per connection before
+	// giving up.
+	DialAttempts int `json:"dial_attempts,omitempty"`
+	// DialTimeout is the overall deadline of a connection attempt including
+	// retries, 0 for no deadline.
+	DialTimeout duration.T `json:"dial_timeout"`
+	// Diversity describes the network diversity rules for multi-hop circuits.
+	Diversity Diversity `json:"diversity,omitempty"`
+}
+
+// Diversity describes the network diversity rules which every pair of hops in
+// a circuit must satisfy.
+type Diversity struct {
+	// Subnet4 is the IPv4 prefix length two hops may not share, 0 disables.
+	Subnet4 int `json:"subnet4"`
+	// Subnet6 is the IPv6 prefix length two hops may not share, 0 disables.
+	Subnet6 int `json:"subnet6"`
+	// Host forbids two hops sharing a hostname or resolved address.
+	Host bool `json:"host"`
 }
 
 // Address describes the listening addresses and ports.
 type Address struct {
-	// Address.Socks is the SOCKSv5 TCP and UDP listening address.
+	// Address.Socks is the SOCKSv5 TCP and UDP listening address, or a
+	// unix:/path socket without UDP support.
 	Socks *string `json:"socks,omitempty"`
-	// Address.H2C is the h2c listening address for local connections.
+	// Address.SocksCredentials is the optional list of "username:password"
+	// credentials SOCKSv5 clients must authenticate with.
+	SocksCredentials *[]string `json:"socks_credentials,omitempty"`
+	// Address.SocksIsolation is the list of stream isolation modes of the
+	// SOCKSv5 listener: socks_auth, dest_addr and/or client_addr.
+	SocksIsolation *[]string `json:"socks_isolation,omitempty"`
+	// Address.H2C is the h2c listening address for local connections, a
+	// host:port or a unix:/path socket.
 	H2C *string `json:"h2c,omitempty"`
+	// Address.H2CIsolation is the list of stream isolation modes of the h2c
+	// listener: dest_addr and/or client_addr.
+	H2CIsolation *[]string `json:"h2c_isolation,omitempty"`
+	// Address.HTTP is the optional HTTP CONNECT and forward proxy listening
+	// address.
+	HTTP *string `json:"http,omitempty"`
+	// Address.Transparent is the optional Linux transparent proxy TCP and
+	// UDP listening address for REDIRECTed or TPROXYed traffic.
+	Transparent *string `json:"transparent,omitempty"`
+	// Address.SocketMode is the octal permissions of unix:/path listening
+	// sockets, 0600 by default or 0660 if Address.SocketGroup is set.
+	SocketMode *string `json:"socket_mode,omitempty"`
+	// Address.SocketGroup is the optional group name or id owning unix:/path
+	// listening sockets.
+	SocketGroup *string `json:"socket_group,omitempty"`
 	// Address.Tun is the listening address configuration for mercury_tun.
 	Tun *string `json:"tun,omitempty"`
+	// Address.Tun6 is the IPv6 address of the tun device, paired like
+	// Address.Tun with the next address in a /127; null for none.
+	Tun6 *string `json:"tun6,omitempty"`
+	// Address.TunStack is how mercury_tun terminates flows: "netstack", in a
+	// userspace TCP/IP stack (default), or "nat", by bouncing packets into
+	// kernel sockets on the tun address.
+	TunStack *string `json:"tun_stack,omitempty"`
+}
+
+// ACL restricts which clients may use the local listeners and which targets
+// they may reach. Target rules are "HOST[:PORTS]": HOST is *, a hostname, a
+// *.domain wildcard, an IP address or a CIDR, PORTS a port or a low-high
+// range; IPv6 addresses with ports are bracketed.
+type ACL struct {
+	// ACL.Clients is the optional list of client CIDRs allowed to connect.
+	Clients *[]string `json:"clients,omitempty"`
+	// ACL.Allow is the optional list of target rules; if set, targets
+	// matching none are refused.
+	Allow *[]string `json:"allow,omitempty"`
+	// ACL.Deny is the optional list of target rules always refused.
+	Deny *[]string `json:"deny,omitempty"`
+}
+
+// DNS describes how mercury_tun handles the DNS queries (port 53) of its
+// clients.
+type DNS struct {
+	// DNS.Intercept answers queries locally instead of relaying each one as a
+	// udp flow: they are sent over a DNS over TCP connection through the
+	// circuit, or answered from DNS.FakePool.
+	Intercept bool `json:"intercept"`
+	// DNS.Upstream is the resolver host:port intercepted queries are sent
+	// to; if null, the one they were addressed to.
+	Upstream *string `json:"upstream,omitempty"`
+	// DNS.FakePool is the optional list of CIDRs, at most one IPv4 and one
+	// IPv6, A and AAAA queries are answered from; flows to these fake
+	// addresses reach the exit relay by hostname.
+	FakePool *[]string `json:"fake_pool,omitempty"`
+}
+
+// Split selects which of the traffic routed into mercury_tun goes through
+// mercury, the rest going direct; it is reloaded by a running mercury_tun.
+// Rules are "HOST[:PORTS]" like ACL target rules: hostnames match the
+// addresses they resolve to and the hostnames of fake address flows, *.domain
+// wildcards only the latter. Rules for any port also apply to the routes
+// into the tun device.
+type Split struct {
+	// Split.Include is the optional list of rules traffic must match to go
+	// through mercury.
+	Include *[]string `json:"include,omitempty"`
+	// Split.Exclude is the optional list of rules of traffic going direct.
+	Exclude *[]string `json:"exclude,omitempty"`
 }
 
 // Defaults provides a config with sane defaults whenever possible.
@@ -57,6 +171,8 @@ func Defaults() C {
 		sksaddr = "127.0.0.1:13491"
 		h2caddr = "127.0.0.1:13492"
 		tunaddr = "10.13.49.0:13493"
+		tun6    = "fd13:4913::"
+		dnsaddr = "1.1.1.1:53"
 	)
 	contractURL, _ := url.Parse("http://34.133.212.204:3001")
 
@@ -67,12 +183,23 @@ func Defaults() C {
 		PofURL:    "http://34.133.212.204:3003/buy?quantity=1",
 		Accesskey: Accesskey{UseOnDemand: true},
 		Timeout:   duration.T(time.Second * 5),
-		Circuit:   Circuit{Hops: 1},
+		Circuit: Circuit{
+			Hops:         1,
+			Selection:    "random",
+			PoolSize:     2,
+			PoolPolicy:   "round_robin",
+			MaxAge:       duration.T(time.Hour),
+			DialAttempts: 3,
+			DialTimeout:  duration.T(30 * time.Second),
+			Diversity:    Diversity{Subnet4: 16, Subnet6: 48, Host: true},
+		},
 		Address: Address{
 			Socks: &sksaddr,
 			H2C:   &h2caddr,
 			Tun:   &tunaddr,
+			Tun6:  &tun6,
 		},
+		DNS: DNS{Intercept: true, Upstream: &dnsaddr},
 	}
 }
 
@@ -94,10 +221,38 @@ func (c *C) Metadata() []*Meta {
 		{"timeout", "str", "Dial timeout duration", &c.Timeout, true},
 		{"contract", "str", "Service contract associated with accesskeys", &c.Contract, true},
 		{"address.socks", "str", "SOCKS5 proxy address of mercury daemon", &c.Address.Socks, true},
+		{"address.socks_credentials", "list", "SOCKS5 username:password credentials required from clients", &c.Address.SocksCredentials, false},
+		{"address.socks_isolation", "list", "Stream isolation modes of SOCKS5 proxy (socks_auth, dest_addr, client_addr)", &c.Address.SocksIsolation, false},
 		{"address.h2c", "str", "H2C proxy address of mercury daemon", &c.Address.H2C, true},
+		{"address.h2c_isolation", "list", "Stream isolation modes of H2C proxy (dest_addr, client_addr)", &c.Address.H2CIsolation, false},
+		{"address.http", "str", "HTTP CONNECT/forward proxy address of mercury daemon", &c.Address.HTTP, true},
+		{"address.transparent", "str", "Transparent proxy address of mercury daemon (linux)", &c.Address.Transparent, true},
+		{"address.socket_mode", "str", "Octal permissions of unix:/path listening sockets", &c.Address.SocketMode, true},
+		{"address.socket_group", "str", "Group owning unix:/path listening sockets", &c.Address.SocketGroup, true},
 		{"address.tun", "str", "TUN device address (not loopback)", &c.Address.Tun, true},
+		{"address.tun6", "str", "TUN device IPv6 address (null for none)", &c.Address.Tun6, true},
+		{"address.tun_stack", "str", "TUN flow termination (netstack, nat)", &c.Address.TunStack, true},
+		{"acl.clients", "list", "Client CIDRs allowed to use the local listeners", &c.ACL.Clients, false},
+		{"acl.allow", "list", "Target rules clients may reach (HOST[:PORTS])", &c.ACL.Allow, false},
+		{"acl.deny", "list", "Target rules clients may never reach (HOST[:PORTS])", &c.ACL.Deny, false},
+		{"dns.intercept", "bool", "Answer DNS queries of TUN clients through a DNS over TCP circuit connection", &c.DNS.Intercept, false},
+		{"dns.upstream", "str", "Resolver of intercepted DNS queries (null for their destination)", &c.DNS.Upstream, true},
+		{"dns.fake_pool", "list", "CIDRs of fake addresses answered to intercepted A/AAAA queries", &c.DNS.FakePool, false},
+		{"split.include", "list", "Rules of TUN traffic going through mercury, the rest going direct (HOST[:PORTS])", &c.Split.Include, false},
+		{"split.exclude", "list", "Rules of TUN traffic going direct (HOST[:PORTS])", &c.Split.Exclude, false},
 		{"circuit.hops", "int", "Number of relay hops to use in a circuit", &c.Circuit.Hops, false},
 		{"circuit.whitelist", "list", "Whitelist of relays to use", &c.Circuit.Whitelist, false},
+		{"circuit.blacklist", "list", "Blacklist of relays to never use", &c.Circuit.Blacklist, false},
+		{"circuit.selection", "str", "Relay selection policy (random or weighted)", &c.Circuit.Selection, true},
+		{"circuit.pool_size", "int", "Number of ready circuits to keep built", &c.Circuit.PoolSize, false},
+		{"circuit.pool_policy", "str", "Circuit pool policy (round_robin, random or fastest)", &c.Circuit.PoolPolicy, true},
+		{"circuit.max_age", "str", "Circuit age after which it is rotated (0s for no limit)", &c.Circuit.MaxAge, true},
+		{"circuit.max_streams", "int", "Number of streams after which a circuit is rotated (0 for no limit)", &c.Circuit.MaxStreams, false},
+		{"circuit.dial_attempts", "int", "Number of circuits to try per connection", &c.Circuit.DialAttempts, false},
+		{"circuit.dial_timeout", "str", "Overall connection deadline including retries (0s for none)", &c.Circuit.DialTimeout, true},
+		{"circuit.diversity.subnet4", "int", "IPv4 prefix length no two hops may share (0 to disable)", &c.Circuit.Diversity.Subnet4, false},
+		{"circuit.diversity.subnet6", "int", "IPv6 prefix length no two hops may share (0 to disable)", &c.Circuit.Diversity.Subnet6, false},
+		{"circuit.diversity.host", "bool", "Forbid two hops sharing a hostname or address", &c.Circuit.Diversity.Host, false},
 		{"accesskey.use_on_demand", "bool", "Activate accesskeys as needed", &c.Accesskey.UseOnDemand, false},
 	}
 }
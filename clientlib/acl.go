@@ -0,0 +1,223 @@
+package clientlib
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ACL restricts the clients of a listener and the targets they may reach. A
+// nil ACL allows everything.
+type ACL struct {
+	clients     []*net.IPNet
+	allow, deny []aclRule
+	// whether the client and allow lists are set, even if empty
+	clientlist, allowlist bool
+}
+
+// aclRule is a target rule: a host pattern or network, and a port range.
+type aclRule struct {
+	raw string
+	// hostname, *.domain wildcard or "*" for any host
+	host string
+	// network, if the rule is an IP address or CIDR
+	network *net.IPNet
+	// port range, 0-65535 for any
+	lo, hi int
+}
+
+// NewACL parses the configured client CIDRs and allow and deny target rules,
+// any of which may be nil. It returns a nil ACL if all of them are.
+func NewACL(clients, allow, deny *[]string) (*ACL, error) {
+	if clients == nil && allow == nil && deny == nil {
+		return nil, nil
+	}
+	a := &ACL{clientlist: clients != nil, allowlist: allow != nil}
+	if clients != nil {
+		for _, c := range *clients {
+			n, err := parseNetwork(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ACL client %q: %w", c, err)
+			}
+			a.clients = append(a.clients, n)
+		}
+	}
+	for _, l := range []struct {
+		rules *[]string
+		r     *[]aclRule
+	}{{allow, &a.allow}, {deny, &a.deny}} {
+		if l.rules == nil {
+			continue
+		}
+		for _, s := range *l.rules {
+			r, err := parseRule(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ACL rule %q: %w", s, err)
+			}
+			*l.r = append(*l.r, r)
+		}
+	}
+	return a, nil
+}
+
+// parseNetwork parses a CIDR or a single IP address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP address or CIDR")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parseRule parses a HOST[:PORTS] target rule.
+func parseRule(s string) (r aclRule, err error) {
+	r = aclRule{raw: s, hi: 0xffff}
+	host, ports, sep := s, "", false
+	switch {
+	case strings.HasPrefix(s, "["):
+		i := strings.Index(s, "]")
+		if i < 0 {
+			return r, fmt.Errorf("missing ]")
+		}
+		host, ports = s[1:i], s[i+1:]
+		if ports != "" {
+			if ports[0] != ':' {
+				return r, fmt.Errorf("expected :PORTS after ]")
+			}
+			ports, sep = ports[1:], true
+		}
+	case strings.Count(s, ":") == 1:
+		i := strings.IndexByte(s, ':')
+		host, ports, sep = s[:i], s[i+1:], true
+	}
+	if sep {
+		lo, hi := ports, ports
+		if i := strings.IndexByte(ports, '-'); i >= 0 {
+			lo, hi = ports[:i], ports[i+1:]
+		}
+		if r.lo, err = strconv.Atoi(lo); err != nil {
+			return r, fmt.Errorf("invalid port %q", lo)
+		}
+		if r.hi, err = strconv.Atoi(hi); err != nil {
+			return r, fmt.Errorf("invalid port %q", hi)
+		}
+		if r.lo < 0 || r.hi > 0xffff || r.lo > r.hi {
+			return r, fmt.Errorf("invalid port range %q", ports)
+		}
+	}
+	switch {
+	case host == "":
+		return r, fmt.Errorf("empty host")
+	case host == "*":
+		r.host = host
+	case net.ParseIP(host) != nil || strings.Contains(host, "/"):
+		if r.network, err = parseNetwork(host); err != nil {
+			return r, err
+		}
+	default:
+		r.host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if strings.Contains(strings.TrimPrefix(r.host, "*."), "*") {
+			return r, fmt.Errorf("wildcards are only allowed as *.domain")
+		}
+	}
+	return r, nil
+}
+
+// matches reports whether the rule matches a target host and port. Hostname
+// rules only match hostnames and network rules only IP addresses, as targets
+// are resolved by the exit relay.
+func (r aclRule) matches(host string, ip net.IP, port int) bool {
+	if port < r.lo || port > r.hi {
+		return false
+	}
+	switch {
+	case r.host == "*":
+		return true
+	case r.network != nil:
+		return ip != nil && r.network.Contains(ip)
+	case ip != nil:
+		return false
+	case strings.HasPrefix(r.host, "*."):
+		return strings.HasSuffix(host, r.host[1:])
+	}
+	return host == r.host
+}
+
+// AllowClient returns an error stating why the client at addr is refused, nil
+// if it is allowed. Unix socket clients are always allowed, access to the
+// socket being controlled by its permissions.
+func (a *ACL) AllowClient(addr net.Addr) error {
+	if a == nil || !a.clientlist {
+		return nil
+	}
+	var ip net.IP
+	switch v := addr.(type) {
+	case *net.UnixAddr:
+		return nil
+	case *net.TCPAddr:
+		ip = v.IP
+	case *net.UDPAddr:
+		ip = v.IP
+	case nil:
+	default:
+		if h, _, err := net.SplitHostPort(addr.String()); err == nil {
+			ip = net.ParseIP(h)
+		}
+	}
+	if ip != nil {
+		for _, n := range a.clients {
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client %s is not in acl.clients", addr)
+}
+
+// AllowTarget returns an error stating why the host:port target is refused,
+// nil if it is allowed.
+func (a *ACL) AllowTarget(target string) error {
+	if a == nil {
+		return nil
+	}
+	host, portstr, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return fmt.Errorf("invalid target port %q", portstr)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	for _, r := range a.deny {
+		if r.matches(host, ip, port) {
+			return fmt.Errorf("target %s matches acl.deny rule %q", target, r.raw)
+		}
+	}
+	if !a.allowlist {
+		return nil
+	}
+	for _, r := range a.allow {
+		if r.matches(host, ip, port) {
+			return nil
+		}
+	}
+	return fmt.Errorf("target %s matches no acl.allow rule", target)
+}
+
+// Allow checks both the client and the target of a stream.
+func (a *ACL) Allow(client net.Addr, target string) error {
+	if err := a.AllowClient(client); err != nil {
+		return err
+	}
+	return a.AllowTarget(target)
+}
@@ -0,0 +1,75 @@
+package clientlib
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	clients := []string{"127.0.0.0/8", "::1", "192.168.1.10"}
+	allow := []string{"*.example.com:443", "example.com", "10.0.0.0/8:80-90", "[2001:db8::/32]:22", "*:53"}
+	deny := []string{"secret.example.com", "10.1.2.3", "*:25"}
+	acl, err := NewACL(&clients, &allow, &deny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		client string
+		target string
+		ok     bool
+	}{
+		{"127.0.0.1:1000", "www.example.com:443", true},
+		{"127.0.0.1:1000", "WWW.Example.COM.:443", true},
+		{"127.0.0.1:1000", "www.example.com:80", false},
+		{"127.0.0.1:1000", "example.com:8080", true},
+		{"127.0.0.1:1000", "badexample.com:443", false},
+		{"127.0.0.1:1000", "secret.example.com:443", false},
+		{"127.0.0.1:1000", "10.9.9.9:85", true},
+		{"127.0.0.1:1000", "10.9.9.9:91", false},
+		{"127.0.0.1:1000", "10.1.2.3:80", false},
+		{"127.0.0.1:1000", "[2001:db8::1]:22", true},
+		{"127.0.0.1:1000", "[2001:db9::1]:22", false},
+		{"127.0.0.1:1000", "8.8.8.8:53", true},
+		{"127.0.0.1:1000", "mail.example.com:25", false},
+		{"[::1]:1000", "www.example.com:443", true},
+		{"192.168.1.10:1000", "www.example.com:443", true},
+		{"192.168.1.11:1000", "www.example.com:443", false},
+	} {
+		client, err := net.ResolveTCPAddr("tcp", tc.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = acl.Allow(client, tc.target); (err == nil) != tc.ok {
+			t.Errorf("%s -> %s: got %v, expected allowed=%v", tc.client, tc.target, err, tc.ok)
+		}
+	}
+}
+
+func TestACLEmpty(t *testing.T) {
+	acl, err := NewACL(nil, nil, nil)
+	if err != nil || acl != nil {
+		t.Fatalf("got %v %v, expected a nil ACL", acl, err)
+	}
+	if err = acl.Allow(nil, "example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	// an empty allow list refuses everything
+	acl, err = NewACL(nil, &[]string{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = acl.AllowTarget("example.com:443"); err == nil {
+		t.Fatal("expected the target to be refused")
+	}
+}
+
+func TestACLInvalid(t *testing.T) {
+	for _, rule := range []string{"", ":80", "example.com:", "example.com:x", "example.com:90-80", "a*.example.com", "[::1", "[::1]80", "10.0.0.0/33"} {
+		if _, err := NewACL(nil, &[]string{rule}, nil); err == nil {
+			t.Errorf("expected rule %q to be invalid", rule)
+		}
+	}
+	if _, err := NewACL(&[]string{"example.com"}, nil, nil); err == nil {
+		t.Error("expected a hostname client to be invalid")
+	}
+}
@@ -1,103 +1,290 @@
 package clientlib
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"time"
 
-	"github.com/M-ERCURY/core/api/relayentry"
 	"github.com/M-ERCURY/core/api/servicekey"
 	"github.com/M-ERCURY/core/api/sharetoken"
 	"github.com/M-ERCURY/core/api/status"
 	"github.com/M-ERCURY/core/api/texturl"
 	"github.com/M-ERCURY/core/mrnet"
+	"github.com/M-ERCURY/core/mrnet/transport"
+	"github.com/M-ERCURY/poc/circuit"
 )
 
+// DialSMFunc connects to a relay or, for target:// urls, to a target.
+// Canceling ctx aborts the connection attempt.
+type DialSMFunc func(ctx context.Context, protocol string, remote *url.URL) (net.Conn, error)
+
+// DialSMContext returns the DialSMFunc of tt. Targets are dialed with the
+// context; relay connections are set up by tt in the background on first use,
+// so they are aborted by closing them.
+func DialSMContext(tt *transport.T) DialSMFunc {
+	return func(ctx context.Context, protocol string, remote *url.URL) (net.Conn, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if remote.Scheme == "target" {
+			return tt.Transport.DialContext(ctx, protocol, remote.Host)
+		}
+		return tt.DialSM(protocol, remote)
+	}
+}
+
+// DialOptions holds the optional parameters of a CircuitDialer.
+type DialOptions struct {
+	// Stats, if not nil, records the throughput of every connection for the
+	// relays of its circuit.
+	Stats *circuit.Stats
+	// Attempts is the maximum number of circuits tried per dial, 1 if unset.
+	Attempts int
+	// Timeout is the overall deadline of a dial including retries, 0 for no
+	// deadline.
+	Timeout time.Duration
+	// Retry returns a freshly built circuit for the isolation key avoiding
+	// the relays in exclude. Required for Attempts > 1.
+	Retry func(key string, exclude circuit.T) (circuit.T, error)
+	// Failed, if not nil, is called with every circuit error which was
+	// retried and thus not returned to the caller.
+	Failed func(error)
+	// Done, if not nil, is called with the circuit of every stream obtained
+	// from circuitf or Retry once it ends: when its connection is closed or
+	// its dial failed.
+	Done func(circuit.T)
+}
+
+// CircuitDialer returns a DialFunc dialing targets through the circuit given
+// by circuitf for the isolation key carried by the dial context. Canceling the
+// context or reaching its deadline aborts the dial at whichever hop it is
+// currently initializing. If a relay fails while the circuit is being set up,
+// the dial is retried on a fresh circuit without it until opts.Attempts
+// circuits were tried or opts.Timeout expires.
+//
+// Relays do not acknowledge CONNECT requests, so failures reported by relays
+// after the dial returned surface as errors reading from the connection and
+// are not retried.
 func CircuitDialer(
 	skf func() (*servicekey.T, error),
-	circuitf func() ([]*relayentry.T, error),
-	dialf func(string, *url.URL) (net.Conn, error),
-) func(string, string) (net.Conn, error) {
-	return func(protocol, target string) (c net.Conn, err error) {
+	circuitf func(string) (circuit.T, error),
+	dialf DialSMFunc,
+	opts DialOptions,
+) DialFunc {
+	return func(ctx context.Context, protocol, target string) (c net.Conn, err error) {
+		if opts.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+			defer cancel()
+		}
+		key := IsolationKey(ctx)
+		if user := Username(ctx); user != "" {
+			log.Printf("dialing %s %s for user %s", protocol, target, user)
+		}
 		sk, err := skf()
 		if err != nil {
 			err = fmt.Errorf("could not obtain fresh servicekey: %w", err)
 			return
 		}
-		circuit, err := circuitf()
+		circ, err := circuitf(key)
 		if err != nil {
 			err = fmt.Errorf("could not obtain circuit: %w", err)
 			return
 		}
-		var st *sharetoken.T
-		for i, link := range circuit {
-			log.Println(
-				"Connecting to circuit link:",
-				link.Role,
-				link.Addr.String(),
-				link.Pubkey.String(),
-			)
-
-			if i == 0 {
-				c, err = dialf("tcp", &link.Addr.URL)
-				if err != nil {
-					// return circuit-specific error
-					err = &status.T{
-						Code:   http.StatusBadGateway,
-						Desc:   err.Error(),
-						Origin: link.Pubkey.String(),
-					}
-					return
-				}
-				continue
+		var exclude circuit.T
+		for i := 1; ; i++ {
+			c, err = dialCircuit(ctx, sk, circ, dialf, protocol, target)
+			if err == nil || i >= opts.Attempts || opts.Retry == nil || !status.IsCircuitError(err) {
+				break
 			}
-
-			/////////////////////////////////////////////
-			st, err = sharetoken.New(sk, circuit[i-1].Pubkey.T())
-			if err != nil {
-				return
+			o := TraceOrigin(err, circ)
+			if o == nil {
+				break
 			}
-			init := &mrnet.Init{
-				Command:  "CONNECT",
-				Protocol: "tcp",
-				Remote:   link.Addr,
-				Token:    st,
-				Version:  &mrnet.PROTO_VERSION,
+			if ctx.Err() != nil {
+				err = fmt.Errorf("dial aborted after %d attempts: %s: %w", i, ctx.Err(), err)
+				break
 			}
-			err = init.WriteTo(c)
-			if err != nil {
-				// return circuit-specific error
-				err = &status.T{
-					Code:   http.StatusBadGateway,
-					Desc:   err.Error(),
-					Origin: link.Pubkey.String(),
-				}
-				return
+			if opts.Failed != nil {
+				opts.Failed(err)
+			}
+			exclude = append(exclude, o)
+			log.Printf("circuit dial failed at %s: %s, retrying on a fresh circuit", o.Pubkey, err)
+			circ0, err0 := opts.Retry(key, exclude)
+			if err0 != nil {
+				log.Printf("could not build fresh circuit: %s", err0)
+				break
 			}
+			if opts.Done != nil {
+				opts.Done(circ)
+			}
+			circ = circ0
 		}
-		///////////////////////
-
-		log.Printf("Now connecting to target: %s", target)
-		st, err = sharetoken.New(sk, circuit[len(circuit)-1].Pubkey.T())
 		if err != nil {
+			if opts.Done != nil {
+				opts.Done(circ)
+			}
 			return
 		}
+		if opts.Stats != nil || opts.Done != nil {
+			c = &meterconn{Conn: c, circ: circ, stats: opts.Stats, done: opts.Done, t0: time.Now()}
+		}
+		return
+	}
+}
+
+// dialCircuit dials target through circ. Relay failures are returned as
+// circuit-specific status errors originating from the failing relay. The
+// connection is closed if ctx is done before the dial completes.
+func dialCircuit(
+	ctx context.Context,
+	sk *servicekey.T,
+	circ circuit.T,
+	dialf DialSMFunc,
+	protocol, target string,
+) (c net.Conn, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	// return circuit-specific error unless the dial was aborted while setting
+	// up link; every init goes over the connection to the first relay, so
+	// failing to write one is that relay's fault, or a local one, not the
+	// fault of the relay it is meant for
+	circerr := func(err error, link int) error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("dial aborted at %s: %w", circ[link].Pubkey, ctx.Err())
+		}
+		return &status.T{
+			Code:   http.StatusBadGateway,
+			Desc:   err.Error(),
+			Origin: circ[0].Pubkey.String(),
+		}
+	}
+	var (
+		trace = ContextDialTrace(ctx)
+		st    *sharetoken.T
+	)
+	for i, link := range circ {
+		log.Println(
+			"Connecting to circuit link:",
+			link.Role,
+			link.Addr.String(),
+			link.Pubkey.String(),
+		)
 
-		u, err := url.Parse("target://" + target)
+		trace.hopStart(i, link)
+		t0 := time.Now()
+		if i == 0 {
+			c, err = dialf(ctx, "tcp", &link.Addr.URL)
+			if err != nil {
+				err = circerr(err, i)
+				trace.hopDone(i, link, since(t0, err))
+				return
+			}
+			if deadline, ok := ctx.Deadline(); ok {
+				c.SetDeadline(deadline)
+			}
+			// abort pending writes on cancellation
+			stop := watch(ctx, c)
+			defer func() {
+				if stop() && err == nil {
+					c, err = nil, ctx.Err()
+				}
+			}()
+			trace.hopDone(i, link, since(t0, nil))
+			continue
+		}
+
+		/////////////////////////////////////////////
+		st, err = sharetoken.New(sk, circ[i-1].Pubkey.T())
+		trace.sharetokenDone(i, since(t0, err))
 		if err != nil {
+			c.Close()
+			trace.hopDone(i, link, since(t0, err))
 			return
 		}
-
 		init := &mrnet.Init{
 			Command:  "CONNECT",
-			Protocol: protocol,
-			Remote:   &texturl.URL{*u},
+			Protocol: "tcp",
+			Remote:   link.Addr,
 			Token:    st,
 			Version:  &mrnet.PROTO_VERSION,
 		}
-		c, err = &mrnet.FragReadConn{Conn: c}, init.WriteTo(c)
+		t1 := time.Now()
+		err = init.WriteTo(c)
+		if err != nil {
+			c.Close()
+			err = circerr(err, i)
+		}
+		trace.initWritten(i, since(t1, err))
+		trace.hopDone(i, link, since(t0, err))
+		if err != nil {
+			return
+		}
+	}
+	///////////////////////
+
+	log.Printf("Now connecting to target: %s", target)
+	trace.connectStart(target)
+	t0 := time.Now()
+	defer func() {
+		trace.connectDone(target, since(t0, err))
+	}()
+	st, err = sharetoken.New(sk, circ[len(circ)-1].Pubkey.T())
+	trace.sharetokenDone(len(circ), since(t0, err))
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	u, err := url.Parse("target://" + target)
+	if err != nil {
+		c.Close()
 		return
 	}
+
+	init := &mrnet.Init{
+		Command:  "CONNECT",
+		Protocol: protocol,
+		Remote:   &texturl.URL{*u},
+		Token:    st,
+		Version:  &mrnet.PROTO_VERSION,
+	}
+	t1 := time.Now()
+	if err = init.WriteTo(c); err != nil {
+		c.Close()
+		err = circerr(err, len(circ)-1)
+	}
+	trace.initWritten(len(circ), since(t1, err))
+	if err != nil {
+		return
+	}
+	if _, ok := ctx.Deadline(); ok {
+		c.SetDeadline(time.Time{})
+	}
+	c = &mrnet.FragReadConn{Conn: c}
+	return
+}
+
+// watch closes c once ctx is done until the returned stop function is called.
+// stop reports whether c was closed.
+func watch(ctx context.Context, c net.Conn) (stop func() bool) {
+	done, closed := make(chan struct{}), make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-closed
+	}
 }
@@ -0,0 +1,67 @@
+package clientlib
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/M-ERCURY/core/api/jsonb"
+	"github.com/M-ERCURY/core/api/relayentry"
+	"github.com/M-ERCURY/core/api/servicekey"
+	"github.com/M-ERCURY/core/api/texturl"
+	"github.com/M-ERCURY/poc/circuit"
+)
+
+// failconn fails writes of data containing fail.
+type failconn struct {
+	net.Conn
+	fail []byte
+}
+
+func (c *failconn) Write(p []byte) (int, error) {
+	if bytes.Contains(p, c.fail) {
+		return 0, errors.New("connection reset")
+	}
+	return len(p), nil
+}
+
+func TestDialCircuitInitOrigin(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk := servicekey.New(priv)
+	var circ circuit.T
+	for i := 1; i <= 3; i++ {
+		pub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		circ = append(circ, &relayentry.T{
+			Role:   "backing",
+			Addr:   texturl.URLMustParse(fmt.Sprintf("mercury://10.0.0.%d:443", i)),
+			Pubkey: jsonb.PK(pub),
+		})
+	}
+	// inits for the second and third relays and for the target
+	for _, fail := range []string{"10.0.0.2:443", "10.0.0.3:443", "target://"} {
+		dialf := func(ctx context.Context, proto string, remote *url.URL) (net.Conn, error) {
+			c0, c1 := net.Pipe()
+			go io.Copy(io.Discard, c1)
+			return &failconn{Conn: c0, fail: []byte(fail)}, nil
+		}
+		_, err := dialCircuit(context.Background(), sk, circ, dialf, "tcp", "example.com:80")
+		if err == nil {
+			t.Fatalf("%s: expected an init write error", fail)
+		}
+		if o := TraceOrigin(err, circ); o != circ[0] {
+			t.Errorf("%s: got origin %v, expected the first relay", fail, o)
+		}
+	}
+}
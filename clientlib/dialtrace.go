@@ -0,0 +1,96 @@
+package clientlib
+
+import (
+	"context"
+	"time"
+
+	"github.com/M-ERCURY/core/api/relayentry"
+)
+
+// DialTrace is a set of hooks run at various stages of a circuit dial, in the
+// style of httptrace.ClientTrace. Any hook may be nil. Hooks are called
+// synchronously from the dialing goroutine.
+type DialTrace struct {
+	// HopStart is called when setting up hop of the circuit starts: dialing
+	// the first relay or initializing a further relay through the previous
+	// one.
+	HopStart func(hop int, r *relayentry.T)
+	// HopDone is called when hop is set up or failed.
+	HopDone func(hop int, r *relayentry.T, info TraceInfo)
+	// SharetokenDone is called after creating the sharetoken authorizing
+	// the init payload of hop. Hop len(circuit) is the target.
+	SharetokenDone func(hop int, info TraceInfo)
+	// InitWritten is called after the init payload of hop was written to
+	// the circuit. Hop len(circuit) is the target.
+	InitWritten func(hop int, info TraceInfo)
+	// ConnectStart is called when requesting the exit relay to connect to
+	// the target starts.
+	ConnectStart func(target string)
+	// ConnectDone is called when the connect request was sent or failed.
+	// Relays do not acknowledge connect requests, so a successful connect
+	// only means the request reached the circuit.
+	ConnectDone func(target string, info TraceInfo)
+}
+
+// TraceInfo describes the outcome of a traced stage of a dial.
+type TraceInfo struct {
+	// Elapsed is the duration of the stage.
+	Elapsed time.Duration
+	// Err is the error the stage failed with, if any.
+	Err error
+}
+
+// dialTraceKey is the context key of dial traces.
+type dialTraceKey struct{}
+
+// WithDialTrace returns a copy of ctx which traces circuit dials with trace.
+func WithDialTrace(ctx context.Context, trace *DialTrace) context.Context {
+	return context.WithValue(ctx, dialTraceKey{}, trace)
+}
+
+// ContextDialTrace returns the DialTrace associated with ctx, if any.
+func ContextDialTrace(ctx context.Context) *DialTrace {
+	trace, _ := ctx.Value(dialTraceKey{}).(*DialTrace)
+	return trace
+}
+
+// since returns the TraceInfo of a stage started at t0 which ended with err.
+func since(t0 time.Time, err error) TraceInfo {
+	return TraceInfo{Elapsed: time.Since(t0), Err: err}
+}
+
+func (t *DialTrace) hopStart(hop int, r *relayentry.T) {
+	if t != nil && t.HopStart != nil {
+		t.HopStart(hop, r)
+	}
+}
+
+func (t *DialTrace) hopDone(hop int, r *relayentry.T, info TraceInfo) {
+	if t != nil && t.HopDone != nil {
+		t.HopDone(hop, r, info)
+	}
+}
+
+func (t *DialTrace) sharetokenDone(hop int, info TraceInfo) {
+	if t != nil && t.SharetokenDone != nil {
+		t.SharetokenDone(hop, info)
+	}
+}
+
+func (t *DialTrace) initWritten(hop int, info TraceInfo) {
+	if t != nil && t.InitWritten != nil {
+		t.InitWritten(hop, info)
+	}
+}
+
+func (t *DialTrace) connectStart(target string) {
+	if t != nil && t.ConnectStart != nil {
+		t.ConnectStart(target)
+	}
+}
+
+func (t *DialTrace) connectDone(target string, info TraceInfo) {
+	if t != nil && t.ConnectDone != nil {
+		t.ConnectDone(target, info)
+	}
+}
@@ -0,0 +1,84 @@
+package clientlib
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/M-ERCURY/poc/socks"
+)
+
+// Stream isolation modes.
+const (
+	// IsolateSOCKSAuth isolates streams by SOCKS username and password.
+	IsolateSOCKSAuth = "socks_auth"
+	// IsolateDestAddr isolates streams by target host.
+	IsolateDestAddr = "dest_addr"
+	// IsolateClientAddr isolates streams by local client address.
+	IsolateClientAddr = "client_addr"
+)
+
+// isolationKey is the context key of stream isolation keys.
+type isolationKey struct{}
+
+// WithIsolationKey returns a copy of ctx carrying the stream isolation key.
+func WithIsolationKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, isolationKey{}, key)
+}
+
+// IsolationKey returns the stream isolation key carried by ctx, "" if none.
+func IsolationKey(ctx context.Context) string {
+	key, _ := ctx.Value(isolationKey{}).(string)
+	return key
+}
+
+// Isolation is a set of stream isolation modes of a listener. Streams with
+// different isolation keys never share a circuit.
+type Isolation []string
+
+// NewIsolation validates the configured isolation modes. A nil list means no
+// isolation.
+func NewIsolation(modes *[]string) (Isolation, error) {
+	if modes == nil {
+		return nil, nil
+	}
+	for _, m := range *modes {
+		switch m {
+		case IsolateSOCKSAuth, IsolateDestAddr, IsolateClientAddr:
+		default:
+			return nil, fmt.Errorf("unknown stream isolation mode: %s", m)
+		}
+	}
+	return Isolation(*modes), nil
+}
+
+// Key returns the isolation key of a stream given its SOCKS credentials (may
+// be nil), client address and target host:port. The key is empty if the
+// listener has no isolation modes.
+func (i Isolation) Key(creds *socks.Credentials, client net.Addr, target string) string {
+	var parts []string
+	for _, m := range i {
+		v := ""
+		switch m {
+		case IsolateSOCKSAuth:
+			if creds != nil {
+				v = creds.Username + ":" + creds.Password
+			}
+		case IsolateDestAddr:
+			v = target
+			if host, _, err := net.SplitHostPort(target); err == nil {
+				v = host
+			}
+		case IsolateClientAddr:
+			if client != nil {
+				v = client.String()
+				if host, _, err := net.SplitHostPort(v); err == nil {
+					v = host
+				}
+			}
+		}
+		parts = append(parts, m+"="+v)
+	}
+	return strings.Join(parts, "\x00")
+}
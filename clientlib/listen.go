@@ -0,0 +1,78 @@
+package clientlib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// UnixPrefix marks listening addresses which are unix domain socket paths.
+const UnixPrefix = "unix:"
+
+// SplitAddr returns the network and address of a listening address: "unix"
+// and the socket path for unix:/path, "tcp" and host:port otherwise.
+func SplitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, UnixPrefix) {
+		return "unix", strings.TrimPrefix(addr, UnixPrefix)
+	}
+	return "tcp", addr
+}
+
+// listen listens on a tcp host:port or unix:/path address. A stale unix
+// socket left behind by a previous process is replaced.
+func listen(addr string) (net.Listener, error) {
+	network, address := SplitAddr(addr)
+	if network == "unix" {
+		if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if c, err := net.Dial("unix", address); err == nil {
+				c.Close()
+				return nil, fmt.Errorf("unix socket %s is in use", address)
+			}
+			os.Remove(address)
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on requested %s address %s: %w", network, address, err)
+	}
+	return l, nil
+}
+
+// SetSocketPerms sets the permissions and, if group is not empty, the group
+// (name or numeric id) of the unix socket of a listening address. It does
+// nothing for tcp addresses.
+func SetSocketPerms(addr string, mode os.FileMode, group string) error {
+	network, path := SplitAddr(addr)
+	if network != "unix" {
+		return nil
+	}
+	if group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return err
+			}
+		}
+		if err = os.Lchown(path, -1, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, mode)
+}
+
+// ParseSocketMode parses an octal unix socket mode such as "0660".
+func ParseSocketMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m&^0777 != 0 {
+		return 0, errors.New("expected octal permissions such as 0660")
+	}
+	return os.FileMode(m), nil
+}
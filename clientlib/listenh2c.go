@@ -1,9 +1,13 @@
 package clientlib
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/M-ERCURY/core/api/status"
 	"github.com/M-ERCURY/core/mrnet"
@@ -13,11 +17,14 @@ import (
 	"golang.org/x/net/http2/h2c"
 )
 
-// ListenH2C listens on the given address, waiting for h2c connection requests
+// ListenH2C listens on the given tcp host:port or unix:/path address, waiting
+// for h2c connection requests
 // to dial through the circuit. The target protocol and address are supplied in
 // the headers which allows using HPACK compression and immediate status
-// feedback.
-func ListenH2C(addr string, tc *tls.Config, dialer DialFunc, errf func(error)) error {
+// feedback: a 200 is sent as soon as the target is dialed, dial failures are
+// answered with their status, see WriteDialStatus. Clients and targets refused
+// by acl are answered with 403.
+func ListenH2C(addr string, tc *tls.Config, iso Isolation, acl *ACL, dialer DialFunc, errf func(error)) error {
 	h := func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPut {
 			status.ErrMethod.WriteTo(w)
@@ -25,11 +32,26 @@ func ListenH2C(addr string, tc *tls.Config, dialer DialFunc, errf func(error)) e
 		}
 		protocol := r.Header.Get("Sm-Dial-Protocol")
 		target := r.Header.Get("Sm-Dial-Target")
-		cc, err := dialer(protocol, target)
+		if err := acl.Allow(clientAddr(r), target); err != nil {
+			log.Printf("h2c request refused: %s", err)
+			status.ErrForbidden.WriteTo(w)
+			return
+		}
+		// the request context is canceled if the client goes away
+		ctx := WithIsolationKey(r.Context(), iso.Key(nil, clientAddr(r), target))
+		cc, err := dialer(ctx, protocol, target)
 		if err != nil {
 			log.Printf("h2->circuit dial failure: %s", err)
+			if !errors.Is(err, context.Canceled) {
+				WriteDialStatus(w, err)
+			}
 			return
 		}
+		// let the client know the target is reachable before any data
+		w.WriteHeader(http.StatusOK)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
 		rwc := h2rwc.T{flushwriter.T{w}, r.Body}
 		err = mrnet.Splice(rwc, cc, 0, 32*1024)
 		if err != nil {
@@ -44,6 +66,45 @@ func ListenH2C(addr string, tc *tls.Config, dialer DialFunc, errf func(error)) e
 		return err
 	}
 	h1s.Handler = h2c.NewHandler(h1s.Handler, h2s)
-	go func() { log.Fatal(h1s.ListenAndServe()) }()
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	go func() { log.Fatal(h1s.Serve(l)) }()
 	return nil
 }
+
+// WriteDialStatus answers an h2c dial request with the status of a failed
+// dial: its code, and its origin, description and cause in the Sm-Status-Origin,
+// Sm-Status-Desc and Sm-Status-Cause headers, followed by its JSON body. Errors
+// not returned by relays are reported as 502 with no origin.
+func WriteDialStatus(w http.ResponseWriter, err error) {
+	var s *status.T
+	if !errors.As(err, &s) {
+		s = status.ErrGateway.Wrap(err)
+	}
+	for k, v := range map[string]string{
+		"Sm-Status-Origin": s.Origin,
+		"Sm-Status-Desc":   s.Desc,
+		"Sm-Status-Cause":  string(s.Cause),
+	} {
+		// header values can't span lines
+		if v = strings.Join(strings.Fields(v), " "); v != "" {
+			w.Header().Set(k, v)
+		}
+	}
+	s.WriteTo(w)
+}
+
+// clientAddr returns the remote address of the client of an h2c or http
+// request, the socket address for unix socket clients.
+func clientAddr(r *http.Request) net.Addr {
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		return local
+	}
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return addr
+}
@@ -0,0 +1,124 @@
+package clientlib
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	"github.com/M-ERCURY/core/mrnet"
+)
+
+// ListenHTTP listens on the given tcp host:port or unix:/path address for
+// HTTP/1.1 proxy requests: CONNECT
+// tunnels as well as plain http:// absolute-URI requests, which are forwarded
+// to their origin. Both are dialed through the circuit; errf, if not nil, is
+// called with dial errors. Forwarded connections are only kept alive for reuse
+// if there is no stream isolation. Clients and targets refused by acl are
+// answered with 403.
+func ListenHTTP(addr string, iso Isolation, acl *ACL, dialer DialFunc, errf func(error)) error {
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	dial := func(ctx context.Context, protocol, target string) (net.Conn, error) {
+		cc, err := dialer(ctx, protocol, target)
+		if err != nil {
+			log.Printf("http->circuit dial failure: %s", err)
+			if errf != nil {
+				errf(err)
+			}
+		}
+		return cc, err
+	}
+	fwd := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			// don't leak the client's address or proxy credentials
+			r.Header["X-Forwarded-For"] = nil
+			r.Header.Del("Proxy-Authorization")
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial(ctx, "tcp", addr)
+			},
+			DisableKeepAlives: len(iso) > 0,
+			IdleConnTimeout:   90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("http proxy error forwarding to %s: %s", r.URL.Host, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			connect(w, r, iso, acl, dial)
+			return
+		}
+		if r.URL.Scheme != "http" || r.URL.Host == "" {
+			http.Error(w, "only CONNECT and absolute http:// requests are proxied", http.StatusBadRequest)
+			return
+		}
+		target := r.URL.Host
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(r.URL.Hostname(), "80")
+		}
+		if err := acl.Allow(clientAddr(r), target); err != nil {
+			log.Printf("http proxy request refused: %s", err)
+			http.Error(w, "forbidden by proxy ACL", http.StatusForbidden)
+			return
+		}
+		// the request context is canceled if the client goes away
+		ctx := WithIsolationKey(r.Context(), iso.Key(nil, clientAddr(r), target))
+		fwd.ServeHTTP(w, r.WithContext(ctx))
+	}
+	s := &http.Server{Handler: http.HandlerFunc(h)}
+	go func() { log.Fatal(s.Serve(l)) }()
+	return nil
+}
+
+// connect handles an HTTP CONNECT request, splicing the client's connection
+// with the target dialed through the circuit.
+func connect(w http.ResponseWriter, r *http.Request, iso Isolation, acl *ACL, dial DialFunc) {
+	target := r.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		http.Error(w, "CONNECT target must be host:port", http.StatusBadRequest)
+		return
+	}
+	if err := acl.Allow(clientAddr(r), target); err != nil {
+		log.Printf("http CONNECT request refused: %s", err)
+		http.Error(w, "forbidden by proxy ACL", http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+	// the request context is canceled if the client goes away
+	ctx := WithIsolationKey(r.Context(), iso.Key(nil, clientAddr(r), target))
+	cc, err := dial(ctx, "tcp", target)
+	if err != nil {
+		http.Error(w, "could not connect through the circuit", http.StatusBadGateway)
+		return
+	}
+	defer cc.Close()
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("error hijacking http CONNECT connection: %s", err)
+		return
+	}
+	defer c.Close()
+	if _, err = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	if n := rw.Reader.Buffered(); n > 0 {
+		// the client sent data before the reply
+		c = &earlyConn{Conn: c, r: io.MultiReader(rw.Reader, c)}
+	}
+	if err = mrnet.Splice(c, cc, 0, 32*1024); err != nil {
+		log.Printf("error splicing http CONNECT connection: %s", err)
+	}
+}
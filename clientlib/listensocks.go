@@ -1,10 +1,14 @@
 package clientlib
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
 	"time"
 
 	"github.com/M-ERCURY/core/mrnet"
@@ -13,29 +17,58 @@ import (
 
 const udpbufsize = 4096 // change if bigger datagrams are expected
 
-type DialFunc func(string, string) (net.Conn, error)
+// DialFunc dials a target via a protocol through the circuit used for the
+// isolation key carried by the context, see WithIsolationKey. The dial is
+// aborted when the context is done.
+type DialFunc func(ctx context.Context, protocol, target string) (net.Conn, error)
 
-// handle everything SOCKSv5-related on the same address
-func ListenSOCKS(addr string, dialer DialFunc, errf func(error)) (err error) {
-	var udpl net.PacketConn
-	var tcpl net.Listener
-	udpl, err = net.ListenPacket("udp", addr)
-	if err != nil {
-		err = fmt.Errorf("could not listen on requested udp address %s: %w", addr, err)
-		return
+// handle everything SOCKS-related on the same address, a tcp host:port with
+// UDP on the same port, or a unix:/path socket without UDP support; errf, if not nil, is
+// called with dial errors. If auth is not nil, clients must authenticate.
+// Clients and targets refused by acl are answered with StatusNotAllowed.
+// Datagrams are only relayed for clients with an open UDP association.
+func ListenSOCKS(
+	addr string,
+	auth socks.Authenticator,
+	iso Isolation,
+	acl *ACL,
+	dialer DialFunc,
+	errf func(error),
+) (err error) {
+	assocs := NewAssociations()
+	var udpaddr net.Addr
+	if network, _ := SplitAddr(addr); network == "tcp" {
+		var udpl net.PacketConn
+		udpl, err = net.ListenPacket("udp", addr)
+		if err != nil {
+			err = fmt.Errorf("could not listen on requested udp address %s: %w", addr, err)
+			return
+		}
+		udpaddr = udpl.LocalAddr()
+		go ProxyUDP(udpl, assocs, iso, acl, dialer, errf)
 	}
-	tcpl, err = net.Listen("tcp", addr)
+	tcpl, err := listen(addr)
 	if err != nil {
-		err = fmt.Errorf("could not listen on requested tcp address %s: %w", addr, err)
 		return
 	}
-	go ProxyUDP(udpl, dialer, errf)
-	go ProxyTCP(tcpl, dialer, errf, udpl.LocalAddr())
+	go ProxyTCP(tcpl, auth, assocs, iso, acl, dialer, errf, udpaddr)
 	return
 }
 
-// handle TCP socks connections
-func ProxyTCP(l net.Listener, dialer DialFunc, errf func(error), udpaddr net.Addr) {
+// handle TCP socks connections, SOCKSv5 as well as SOCKS4 and SOCKS4a CONNECT
+// requests; UDP associations are recorded in assocs and
+// last until the client closes the connection or they are idle, and are not
+// supported if udpaddr is nil
+func ProxyTCP(
+	l net.Listener,
+	auth socks.Authenticator,
+	assocs *Associations,
+	iso Isolation,
+	acl *ACL,
+	dialer DialFunc,
+	errf func(error),
+	udpaddr net.Addr,
+) {
 	pause := 1 * time.Second
 	for {
 		c0, err := l.Accept()
@@ -46,85 +79,217 @@ func ProxyTCP(l net.Listener, dialer DialFunc, errf func(error), udpaddr net.Add
 		}
 		go func() {
 			log.Printf("SOCKSv5 tcp socket accepted: %s -> %s", c0.RemoteAddr(), c0.LocalAddr())
-			cmd, addr, err := socks.Handshake(c0)
+			ver, cmd, addr, creds, err := socks.Handshake(c0, auth)
 			if err != nil {
-				log.Printf("SOCKSv5 tcp socket handshake error: %s", err)
+				log.Printf("SOCKS tcp socket handshake error: %s", err)
+				c0.Close()
+				return
+			}
+			reply := func(status socks.SocksStatus, addr socks.Addr) {
+				if ver == socks.SOCKSv4 {
+					socks.WriteStatus4(c0, status, addr)
+				} else {
+					socks.WriteStatus(c0, status, addr)
+				}
+			}
+			if cmd == socks.UDP_ASSOC {
+				// datagram targets are checked by ProxyUDP
+				err = acl.AllowClient(c0.RemoteAddr())
+			} else {
+				err = acl.Allow(c0.RemoteAddr(), addr)
+			}
+			if err != nil {
+				log.Printf("SOCKS request refused: %s", err)
+				reply(socks.StatusNotAllowed, socks.AddrAddr(c0.LocalAddr()))
 				c0.Close()
 				return
 			}
 			switch cmd {
 			case socks.CONNECT:
 				defer c0.Close()
-				c1, err := dialer("tcp", addr)
+				ctx := WithIsolationKey(context.Background(), iso.Key(creds, c0.RemoteAddr(), addr))
+				if auth != nil {
+					ctx = WithUsername(ctx, creds.Username)
+				}
+				ctx, stop := hangup(ctx, c0)
+				c1, err := dialer(ctx, "tcp", addr)
+				c0 = stop()
 				if err != nil {
 					log.Printf("error dialing tcp through the circuit: %s", err)
-					socks.WriteStatus(c0, socks.StatusGeneralFailure, socks.AddrAddr(c0.LocalAddr()))
-					errf(err)
+					reply(socks.StatusGeneralFailure, socks.AddrAddr(c0.LocalAddr()))
+					if errf != nil {
+						errf(err)
+					}
 					return
 				}
-				socks.WriteStatus(c0, socks.StatusOK, socks.AddrAddr(c0.LocalAddr()))
+				reply(socks.StatusOK, socks.AddrAddr(c0.LocalAddr()))
 				if err = mrnet.Splice(c0, c1, 0, 32768); err != nil {
 					log.Printf("error splicing initial connection: %s", err)
 				}
 			case socks.UDP_ASSOC:
-				socks.WriteStatus(c0, socks.StatusOK, socks.AddrAddr(udpaddr))
+				if udpaddr == nil {
+					reply(socks.StatusCommandNotSupported, socks.AddrAddr(c0.LocalAddr()))
+					c0.Close()
+					return
+				}
+				a := assocs.open(c0.RemoteAddr(), addr, creds)
+				defer assocs.close(a)
+				defer c0.Close()
+				reply(socks.StatusOK, socks.AddrAddr(udpaddr))
+				a.hold(c0)
+				log.Printf("SOCKSv5 udp association closed: %s", c0.RemoteAddr())
 			default:
-				socks.WriteStatus(c0, socks.StatusCommandNotSupported, socks.AddrAddr(l.Addr()))
+				reply(socks.StatusCommandNotSupported, socks.AddrAddr(l.Addr()))
 				c0.Close()
 			}
 		}()
 	}
 }
 
-// handle UDP packets
-func ProxyUDP(l net.PacketConn, dialer DialFunc, errf func(error)) {
+// handle UDP packets; only packets from client addresses of an open UDP
+// association are handled, using one circuit connection per client address
+// and destination for the lifetime of the association
+func ProxyUDP(l net.PacketConn, assocs *Associations, iso Isolation, acl *ACL, dialer DialFunc, errf func(error)) {
 	l.(*net.UDPConn).SetWriteBuffer(2147483647)
 	l.(*net.UDPConn).SetReadBuffer(2147483647)
+	frags := socks.NewReassembler(socks.DefaultFragTimeout)
 	for {
-		ibuf, obuf := make([]byte, udpbufsize), make([]byte, udpbufsize)
+		ibuf := make([]byte, udpbufsize)
 		n, laddr, err := l.ReadFrom(ibuf)
 		if err != nil {
 			log.Printf("error while reading udp packet from %s: %s", laddr, err)
 			continue
 		}
+		a := assocs.lookup(laddr)
+		if a == nil {
+			log.Printf("dropping udp packet from %s without SOCKSv5 udp association", laddr)
+			continue
+		}
+		frag, dstaddr, data, err := socks.DissectUDP(ibuf[:n])
+		if err != nil {
+			log.Printf("dropping invalid udp packet from %s: %s", laddr, err)
+			continue
+		}
+		dstaddr, data, ok := frags.Add(laddr.String(), frag, dstaddr, data)
+		if !ok {
+			// waiting for more fragments
+			continue
+		}
+		if err := acl.AllowTarget(dstaddr.String()); err != nil {
+			log.Printf("dropping udp packet from %s: %s", laddr, err)
+			continue
+		}
+		f, created := a.flow(laddr, dstaddr.String())
+		if f == nil {
+			// association closed meanwhile
+			continue
+		}
+		select {
+		case f.queue <- data:
+		default:
+			log.Printf("dropping udp packet from %s: queue to %s is full", laddr, dstaddr)
+		}
+		if !created {
+			continue
+		}
 		go func() {
-			srcaddr, dstaddr, data := socks.DissectUDP(ibuf[:n])
-			conn, err := dialer("udp", dstaddr.String())
+			ctx := WithIsolationKey(a.ctx, iso.Key(a.creds, laddr, dstaddr.String()))
+			conn, err := dialer(ctx, "udp", dstaddr.String())
+			a.done(f, conn, err)
 			if err != nil {
+				if a.ctx.Err() != nil {
+					// association closed while dialing
+					return
+				}
 				log.Printf(
 					"error dialing udp %s->%s->%s through the circuit: %s",
 					laddr, l.LocalAddr(), dstaddr, err,
 				)
-				errf(err)
+				if errf != nil {
+					errf(err)
+				}
 				return
 			}
-			_, err = conn.Write(data)
-			if err != nil {
-				log.Printf(
-					"error when writing initial data to %s->%s->%s udp tunnel: %s",
-					laddr, l.LocalAddr(), dstaddr, err,
-				)
+			if f.err != nil {
+				// association closed while dialing
 				return
 			}
-			for {
-				n, err := conn.Read(obuf)
-				if err != nil {
-					if err != io.EOF {
-						log.Printf("error reading %s<-%s<-%s via udp: %s", laddr, l.LocalAddr(), dstaddr, err)
+			go func() {
+				defer a.forget(f)
+				obuf := make([]byte, udpbufsize)
+				for {
+					n, err := f.conn.Read(obuf)
+					if err != nil {
+						if err != io.EOF && a.ctx.Err() == nil {
+							log.Printf("error reading %s<-%s<-%s via udp: %s", laddr, l.LocalAddr(), dstaddr, err)
+						}
+						return
+					}
+					a.touch()
+					b, err := socks.ComposeUDP(dstaddr, obuf[:n])
+					if err != nil {
+						log.Printf("error writing %s<-%s<-%s via udp: %s", laddr, l.LocalAddr(), dstaddr, err)
+						return
+					}
+					_, err = l.WriteTo(b, laddr)
+					if err != nil {
+						log.Printf("error writing %s<-%s<-%s via udp: %s", laddr, l.LocalAddr(), dstaddr, err)
+						return
 					}
-					break
-				}
-				b, err := socks.ComposeUDP(srcaddr, dstaddr, obuf[:n])
-				if err != nil {
-					log.Printf("error writing %s<-%s<-%s via udp: %s", laddr, l.LocalAddr(), dstaddr, err)
-					break
 				}
-				_, err = l.WriteTo(b, laddr)
-				if err != nil {
-					log.Printf("error writing %s<-%s<-%s via udp: %s", laddr, l.LocalAddr(), dstaddr, err)
-					break
+			}()
+			// the single writer of the flow, so datagrams keep their order
+			for {
+				select {
+				case data := <-f.queue:
+					if _, err := f.conn.Write(data); err != nil {
+						log.Printf(
+							"error writing %s->%s->%s via udp: %s",
+							laddr, l.LocalAddr(), dstaddr, err,
+						)
+						a.forget(f)
+						return
+					}
+				case <-a.ctx.Done():
+					return
 				}
 			}
 		}()
 	}
 }
+
+// hangup returns a context canceled if the client on c hangs up before the
+// returned stop function is called. stop returns c with any data the client
+// sent early left to be read.
+func hangup(ctx context.Context, c net.Conn) (context.Context, func() net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	var (
+		b    = make([]byte, 1)
+		read = make(chan int, 1)
+	)
+	go func() {
+		n, err := c.Read(b)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+		read <- n
+	}()
+	return ctx, func() net.Conn {
+		c.SetReadDeadline(time.Now())
+		n := <-read
+		c.SetReadDeadline(time.Time{})
+		cancel()
+		if n > 0 {
+			return &earlyConn{Conn: c, r: io.MultiReader(bytes.NewReader(b[:n]), c)}
+		}
+		return c
+	}
+}
+
+// earlyConn is a net.Conn reading data which was read ahead first.
+type earlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *earlyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
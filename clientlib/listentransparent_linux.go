@@ -0,0 +1,395 @@
+package clientlib
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/M-ERCURY/core/mrnet"
+	"golang.org/x/sys/unix"
+)
+
+// transparentIdle is how long a transparently proxied UDP flow may go without
+// datagrams in either direction before it is closed.
+const transparentIdle = 2 * time.Minute
+
+// ListenTransparent listens on the given address for TCP connections and UDP
+// datagrams redirected by the firewall and dials their original destination
+// through the circuit; errf, if not nil, is called with dial errors. Clients
+// and targets refused by acl are dropped. TCP may
+// be redirected with REDIRECT or TPROXY, UDP only with TPROXY, which requires
+// CAP_NET_ADMIN. Without it only REDIRECTed TCP is proxied.
+func ListenTransparent(addr string, iso Isolation, acl *ACL, dialer DialFunc, errf func(error)) error {
+	var transparent error
+	lc := net.ListenConfig{Control: func(network, address string, rc syscall.RawConn) error {
+		// optional for REDIRECT
+		transparent = setTransparent(network, rc)
+		return nil
+	}}
+	tcpl, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on requested tcp address %s: %w", addr, err)
+	}
+	go proxyTransparentTCP(tcpl, iso, acl, dialer, errf)
+	if transparent != nil {
+		log.Printf("transparent proxy: TPROXY disabled, only REDIRECTed tcp is proxied: %s", transparent)
+		return nil
+	}
+	lc.Control = func(network, address string, rc syscall.RawConn) error {
+		if err := setTransparent(network, rc); err != nil {
+			return err
+		}
+		return setRecvOrigDst(network, rc)
+	}
+	udpl, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		tcpl.Close()
+		return fmt.Errorf("could not listen on requested udp address %s: %w", addr, err)
+	}
+	p := &tproxyUDP{
+		l:      udpl.(*net.UDPConn),
+		iso:    iso,
+		acl:    acl,
+		dialer: dialer,
+		errf:   errf,
+		flows:  map[string]*tflow{},
+	}
+	go p.run()
+	return nil
+}
+
+// setTransparent sets IP_TRANSPARENT on a socket so it can accept TPROXYed
+// traffic and bind non-local addresses.
+func setTransparent(network string, rc syscall.RawConn) (err error) {
+	cerr := rc.Control(func(fd uintptr) {
+		if network == "tcp6" || network == "udp6" {
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+				return
+			}
+		}
+		// also applies to IPv4 traffic on dual-stack sockets
+		err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return
+}
+
+// setRecvOrigDst asks for the original destination of received datagrams.
+func setRecvOrigDst(network string, rc syscall.RawConn) (err error) {
+	cerr := rc.Control(func(fd uintptr) {
+		if network == "udp6" {
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+				return
+			}
+		}
+		err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return
+}
+
+// handle redirected TCP connections
+func proxyTransparentTCP(l net.Listener, iso Isolation, acl *ACL, dialer DialFunc, errf func(error)) {
+	pause := 1 * time.Second
+	for {
+		c0, err := l.Accept()
+		if err != nil {
+			log.Printf("transparent tcp socket accept error: %s, pausing for %s", err, pause)
+			time.Sleep(pause)
+			continue
+		}
+		go func() {
+			defer c0.Close()
+			dst, err := origDst(c0.(*net.TCPConn))
+			if err != nil {
+				log.Printf("could not get original destination of %s: %s", c0.RemoteAddr(), err)
+				return
+			}
+			if dst == l.Addr().String() {
+				log.Printf("refusing direct connection to transparent proxy from %s", c0.RemoteAddr())
+				return
+			}
+			if err = acl.Allow(c0.RemoteAddr(), dst); err != nil {
+				log.Printf("transparent tcp connection refused: %s", err)
+				return
+			}
+			log.Printf("transparent tcp socket accepted: %s -> %s", c0.RemoteAddr(), dst)
+			ctx := WithIsolationKey(context.Background(), iso.Key(nil, c0.RemoteAddr(), dst))
+			ctx, stop := hangup(ctx, c0)
+			c1, err := dialer(ctx, "tcp", dst)
+			c0 = stop()
+			if err != nil {
+				log.Printf("error dialing tcp through the circuit: %s", err)
+				if errf != nil {
+					errf(err)
+				}
+				return
+			}
+			if err = mrnet.Splice(c0, c1, 0, 32768); err != nil {
+				log.Printf("error splicing transparent connection: %s", err)
+			}
+		}()
+	}
+}
+
+// origDst returns the original destination of a connection redirected with
+// REDIRECT, which is kept by conntrack, or TPROXY, which leaves it as the
+// connection's local address.
+func origDst(c *net.TCPConn) (string, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	local := c.LocalAddr().(*net.TCPAddr)
+	var (
+		ip   net.IP
+		port int
+		serr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// struct sockaddr_in fits in the 16 bytes of an ipv6_mreq
+			var mreq *unix.IPv6Mreq
+			mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if serr == nil {
+				ip = net.IP(append([]byte(nil), mreq.Multiaddr[4:8]...))
+				port = int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4]))
+			}
+			return
+		}
+		// struct sockaddr_in6 starts an ip6_mtuinfo; IP6T_SO_ORIGINAL_DST has
+		// the same value as SO_ORIGINAL_DST
+		var info *unix.IPv6MTUInfo
+		info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+		if serr == nil {
+			ip = net.IP(append([]byte(nil), info.Addr.Addr[:]...))
+			port = int(ntohs(info.Addr.Port))
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if serr != nil {
+		if serr != unix.ENOENT {
+			return "", serr
+		}
+		// not REDIRECTed, so TPROXYed or direct
+		return local.String(), nil
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+// ntohs converts a port in network byte order as stored in a sockaddr.
+func ntohs(p uint16) uint16 {
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], p)
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// tproxyUDP relays TPROXYed UDP datagrams, using one circuit connection per
+// client address and original destination.
+type tproxyUDP struct {
+	l      *net.UDPConn
+	iso    Isolation
+	acl    *ACL
+	dialer DialFunc
+	errf   func(error)
+
+	mu    sync.Mutex
+	flows map[string]*tflow
+}
+
+// tflow is a transparently proxied UDP flow. Replies are sent from a socket
+// bound to the original destination, so that the client accepts them.
+type tflow struct {
+	ready chan struct{}
+	conn  net.Conn
+	reply net.PacketConn
+	err   error
+	used  time.Time
+}
+
+// close closes the connections of a dialed flow.
+func (f *tflow) close() {
+	if f.err == nil {
+		f.conn.Close()
+		f.reply.Close()
+	}
+}
+
+// run reads datagrams and closes idle flows.
+func (p *tproxyUDP) run() {
+	go func() {
+		t := time.NewTicker(transparentIdle / 4)
+		defer t.Stop()
+		for range t.C {
+			p.mu.Lock()
+			for k, f := range p.flows {
+				if time.Since(f.used) > transparentIdle {
+					delete(p.flows, k)
+					go func(f *tflow) {
+						<-f.ready
+						f.close()
+					}(f)
+				}
+			}
+			p.mu.Unlock()
+		}
+	}()
+	oob := make([]byte, 1024)
+	for {
+		b := make([]byte, udpbufsize)
+		n, oobn, _, client, err := p.l.ReadMsgUDP(b, oob)
+		if err != nil {
+			log.Printf("error while reading transparent udp packet: %s", err)
+			continue
+		}
+		dst, err := origDstUDP(oob[:oobn])
+		if err != nil {
+			log.Printf("dropping transparent udp packet from %s: %s", client, err)
+			continue
+		}
+		if dst.String() == p.l.LocalAddr().String() {
+			log.Printf("dropping udp packet sent directly to transparent proxy from %s", client)
+			continue
+		}
+		if err := p.acl.Allow(client, dst.String()); err != nil {
+			log.Printf("dropping transparent udp packet: %s", err)
+			continue
+		}
+		go p.forward(client, dst, b[:n])
+	}
+}
+
+// forward sends data from client to dst, dialing the flow if needed.
+func (p *tproxyUDP) forward(client, dst *net.UDPAddr, data []byte) {
+	k := client.String() + "\x00" + dst.String()
+	p.mu.Lock()
+	f := p.flows[k]
+	created := f == nil
+	if created {
+		f = &tflow{ready: make(chan struct{})}
+		p.flows[k] = f
+	}
+	f.used = time.Now()
+	p.mu.Unlock()
+	if created {
+		f.conn, f.reply, f.err = p.dial(client, dst)
+		if f.err != nil {
+			p.mu.Lock()
+			if p.flows[k] == f {
+				delete(p.flows, k)
+			}
+			p.mu.Unlock()
+		}
+		close(f.ready)
+		if f.err != nil {
+			return
+		}
+		go p.read(k, f, client)
+	} else {
+		<-f.ready
+	}
+	if f.err != nil {
+		return
+	}
+	if _, err := f.conn.Write(data); err != nil {
+		log.Printf("error writing %s->%s via udp: %s", client, dst, err)
+	}
+}
+
+// dial dials dst through the circuit and binds the reply socket of a flow.
+func (p *tproxyUDP) dial(client, dst *net.UDPAddr) (net.Conn, net.PacketConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, rc syscall.RawConn) error {
+		if err := setTransparent(network, rc); err != nil {
+			return err
+		}
+		var err error
+		cerr := rc.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	reply, err := lc.ListenPacket(context.Background(), "udp", dst.String())
+	if err != nil {
+		log.Printf("could not bind transparent udp reply socket to %s: %s", dst, err)
+		return nil, nil, err
+	}
+	ctx := WithIsolationKey(context.Background(), p.iso.Key(nil, client, dst.String()))
+	conn, err := p.dialer(ctx, "udp", dst.String())
+	if err != nil {
+		reply.Close()
+		log.Printf("error dialing udp %s->%s through the circuit: %s", client, dst, err)
+		if p.errf != nil {
+			p.errf(err)
+		}
+		return nil, nil, err
+	}
+	return conn, reply, nil
+}
+
+// read sends datagrams received on the flow's circuit connection back to the
+// client until it is closed.
+func (p *tproxyUDP) read(k string, f *tflow, client *net.UDPAddr) {
+	defer func() {
+		p.mu.Lock()
+		if p.flows[k] == f {
+			delete(p.flows, k)
+		}
+		p.mu.Unlock()
+		f.close()
+	}()
+	b := make([]byte, udpbufsize)
+	for {
+		n, err := f.conn.Read(b)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		f.used = time.Now()
+		p.mu.Unlock()
+		if _, err = f.reply.WriteTo(b[:n], client); err != nil {
+			log.Printf("error writing %s<-%s via udp: %s", client, f.reply.LocalAddr(), err)
+			return
+		}
+	}
+}
+
+// origDstUDP returns the original destination of a TPROXYed datagram from its
+// control messages.
+func origDstUDP(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= 8:
+			// struct sockaddr_in
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[4:8]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= 24:
+			// struct sockaddr_in6
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("no original destination, was it TPROXYed?")
+}
@@ -0,0 +1,88 @@
+package clientlib
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/M-ERCURY/poc/circuit"
+)
+
+const (
+	// minimum amount of bytes transferred and of active transfer time for a
+	// connection to yield a meaningful throughput sample
+	meterMinBytes  = 64 * 1024
+	meterMinActive = 100 * time.Millisecond
+	// longest pause between reads or writes counted as transfer time, longer
+	// ones are idle time
+	meterMaxGap = time.Second
+)
+
+// meterconn counts the bytes going through a circuit connection and reports
+// the observed throughput to relay stats, if not nil, and the end of the
+// stream to done, if not nil, when closed. Throughput is measured over the
+// time data is moving, so that idle keep-alive connections don't count as
+// slow.
+type meterconn struct {
+	net.Conn
+	circ  circuit.T
+	stats *circuit.Stats
+	done  func(circuit.T)
+	t0    time.Time
+	n     int64
+	once  sync.Once
+
+	mu     sync.Mutex // guards last and active
+	last   time.Time
+	active time.Duration
+}
+
+func (c *meterconn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.count(n)
+	return
+}
+
+func (c *meterconn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	c.count(n)
+	return
+}
+
+// count records n bytes transferred now, adding the time since the previous
+// transfer to the active time unless the connection was idle meanwhile.
+func (c *meterconn) count(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&c.n, int64(n))
+	now := time.Now()
+	c.mu.Lock()
+	last := c.last
+	if last.IsZero() {
+		last = c.t0
+	}
+	if d := now.Sub(last); d <= meterMaxGap {
+		c.active += d
+	}
+	c.last = now
+	c.mu.Unlock()
+}
+
+func (c *meterconn) Close() error {
+	c.once.Do(func() {
+		if c.done != nil {
+			c.done(c.circ)
+		}
+		c.mu.Lock()
+		d := c.active
+		c.mu.Unlock()
+		if n := atomic.LoadInt64(&c.n); c.stats != nil && n >= meterMinBytes && d >= meterMinActive {
+			for _, r := range c.circ {
+				c.stats.ObserveTransfer(r, n, d)
+			}
+		}
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,54 @@
+package clientlib
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/M-ERCURY/core/api/jsonb"
+	"github.com/M-ERCURY/core/api/relayentry"
+	"github.com/M-ERCURY/poc/circuit"
+)
+
+func TestMeterconnIdle(t *testing.T) {
+	r := &relayentry.T{Pubkey: jsonb.PK("relay")}
+	stats := circuit.NewStats()
+	c0, c1 := net.Pipe()
+	go io.Copy(io.Discard, c1)
+	c := &meterconn{Conn: c0, circ: circuit.T{r}, stats: stats, t0: time.Now()}
+	// a long idle pause, then bursts of data over active time
+	time.Sleep(meterMaxGap + 100*time.Millisecond)
+	b := make([]byte, meterMinBytes/8)
+	for i := 0; i < 8; i++ {
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.Close()
+	c1.Close()
+	m, ok := stats.Get(r)
+	if !ok {
+		t.Fatal("no throughput sample")
+	}
+	// 64KiB over ~140ms of transfer, not over the idle pause
+	if min := float64(meterMinBytes); m.Throughput < min {
+		t.Fatalf("got throughput %.0f B/s, expected idle time left out", m.Throughput)
+	}
+}
+
+func TestMeterconnShort(t *testing.T) {
+	r := &relayentry.T{Pubkey: jsonb.PK("relay")}
+	stats := circuit.NewStats()
+	c0, c1 := net.Pipe()
+	go io.Copy(io.Discard, c1)
+	c := &meterconn{Conn: c0, circ: circuit.T{r}, stats: stats, t0: time.Now()}
+	// enough bytes, but in a single write taking no measurable time
+	c.Write(make([]byte, meterMinBytes))
+	c.Close()
+	c1.Close()
+	if _, ok := stats.Get(r); ok {
+		t.Fatal("sample taken from a transfer shorter than meterMinActive")
+	}
+}
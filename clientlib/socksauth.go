@@ -0,0 +1,59 @@
+package clientlib
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"github.com/M-ERCURY/poc/socks"
+)
+
+// NewSOCKSAuth returns an authenticator accepting the configured
+// "username:password" credentials. A nil list means no authentication is
+// required and a nil authenticator is returned.
+func NewSOCKSAuth(creds *[]string) (socks.Authenticator, error) {
+	if creds == nil {
+		return nil, nil
+	}
+	users := map[string]string{}
+	for _, c := range *creds {
+		i := strings.IndexByte(c, ':')
+		if i < 1 {
+			return nil, fmt.Errorf("invalid SOCKS credentials %q, expected username:password", c)
+		}
+		users[c[:i]] = c[i+1:]
+	}
+	return func(c *socks.Credentials) bool {
+		pass, ok := users[c.Username]
+		// compare anyway to not leak which usernames exist
+		eq := subtle.ConstantTimeCompare([]byte(pass), []byte(c.Password)) == 1
+		return ok && eq
+	}, nil
+}
+
+// SOCKSCredential returns the first of the configured "username:password"
+// credentials, for local clients such as mercury exec scripts to
+// authenticate with; ok is false if none are configured.
+func SOCKSCredential(creds *[]string) (user, pass string, ok bool) {
+	if creds == nil || len(*creds) == 0 {
+		return "", "", false
+	}
+	user, pass, ok = strings.Cut((*creds)[0], ":")
+	return
+}
+
+// usernameKey is the context key of authenticated usernames.
+type usernameKey struct{}
+
+// WithUsername returns a copy of ctx carrying the authenticated username of
+// the client a dial is made for.
+func WithUsername(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, usernameKey{}, user)
+}
+
+// Username returns the authenticated username carried by ctx, "" if none.
+func Username(ctx context.Context) string {
+	user, _ := ctx.Value(usernameKey{}).(string)
+	return user
+}
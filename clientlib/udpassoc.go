@@ -0,0 +1,218 @@
+package clientlib
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/M-ERCURY/poc/socks"
+)
+
+// udpIdle is how long a UDP association may go without datagrams in either
+// direction before it is torn down.
+const udpIdle = 5 * time.Minute
+
+// flowQueue is how many datagrams a flow holds while its circuit connection
+// is dialed or busy; more are dropped.
+const flowQueue = 64
+
+// Associations tracks the open SOCKSv5 UDP associations of a listener. Only
+// datagrams from a client address belonging to an association are relayed.
+type Associations struct {
+	mu     sync.Mutex
+	assocs map[*association]struct{}
+}
+
+// NewAssociations creates an empty set of UDP associations.
+func NewAssociations() *Associations {
+	return &Associations{assocs: map[*association]struct{}{}}
+}
+
+// association is a UDP association opened by a TCP control connection. It
+// holds one circuit connection per (client address, destination).
+type association struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	creds  *socks.Credentials
+	// client host and udp port, "" until the first datagram if the client
+	// did not say which port it sends from
+	host, port string
+
+	mu    sync.Mutex
+	flows map[string]*flow
+	used  time.Time
+}
+
+// flow is the circuit connection carrying datagrams between a client address
+// and a destination. Datagrams are queued and written in order by a single
+// writer.
+type flow struct {
+	key   string
+	queue chan []byte
+	conn  net.Conn
+	err   error
+}
+
+// host returns the host part of addr.
+func host(addr net.Addr) string {
+	h, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return h
+}
+
+// open records a UDP association for the client of a TCP control connection.
+// from is the address the client announced it sends datagrams from, "" if
+// unknown; only its port is used, the host is always the one of client.
+func (s *Associations) open(client net.Addr, from string, creds *socks.Credentials) *association {
+	a := &association{
+		creds: creds,
+		host:  host(client),
+		flows: map[string]*flow{},
+		used:  time.Now(),
+	}
+	if _, port, err := net.SplitHostPort(from); err == nil && port != "0" {
+		a.port = port
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	if creds != nil {
+		a.ctx = WithUsername(a.ctx, creds.Username)
+	}
+	s.mu.Lock()
+	s.assocs[a] = struct{}{}
+	s.mu.Unlock()
+	return a
+}
+
+// close removes the association and closes its circuit connections.
+func (s *Associations) close(a *association) {
+	s.mu.Lock()
+	delete(s.assocs, a)
+	s.mu.Unlock()
+	a.cancel()
+	a.mu.Lock()
+	for _, f := range a.flows {
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	}
+	a.flows = map[string]*flow{}
+	a.mu.Unlock()
+}
+
+// lookup returns the association of the client address addr, nil if there is
+// none. An association without a known port is bound to the port of the first
+// datagram from its host.
+func (s *Associations) lookup(addr net.Addr) *association {
+	h, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unbound *association
+	for a := range s.assocs {
+		if a.host != h {
+			continue
+		}
+		if a.port == port {
+			return a
+		}
+		if a.port == "" && unbound == nil {
+			unbound = a
+		}
+	}
+	if unbound != nil {
+		unbound.port = port
+	}
+	return unbound
+}
+
+// hold keeps the association open until the client closes the control
+// connection c or the association has been idle for udpIdle, then closes c.
+func (a *association) hold(c net.Conn) {
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, c)
+		close(closed)
+	}()
+	t := time.NewTicker(udpIdle / 10)
+	defer t.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-t.C:
+			if a.idle() >= udpIdle {
+				c.Close()
+				<-closed
+				return
+			}
+		}
+	}
+}
+
+// touch marks the association as used.
+func (a *association) touch() {
+	a.mu.Lock()
+	a.used = time.Now()
+	a.mu.Unlock()
+}
+
+// idle returns how long the association has been unused.
+func (a *association) idle() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return time.Since(a.used)
+}
+
+// flow returns the flow from the client address addr to dst, creating it if
+// needed. The caller creating the flow must dial it, call done and then write
+// out its queue.
+func (a *association) flow(addr net.Addr, dst string) (f *flow, created bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.used = time.Now()
+	select {
+	case <-a.ctx.Done():
+		return nil, false
+	default:
+	}
+	k := addr.String() + "\x00" + dst
+	if f = a.flows[k]; f != nil {
+		return f, false
+	}
+	f = &flow{key: k, queue: make(chan []byte, flowQueue)}
+	a.flows[k] = f
+	return f, true
+}
+
+// done sets the result of dialing f. Failed flows are forgotten so that the
+// next datagram dials again; flows dialed after the association was closed
+// are closed.
+func (a *association) done(f *flow, conn net.Conn, err error) {
+	a.mu.Lock()
+	if err == nil && a.flows[f.key] != f {
+		conn.Close()
+		conn, err = nil, context.Canceled
+	}
+	f.conn, f.err = conn, err
+	if err != nil && a.flows[f.key] == f {
+		delete(a.flows, f.key)
+	}
+	a.mu.Unlock()
+}
+
+// forget removes f once its circuit connection has failed.
+func (a *association) forget(f *flow) {
+	a.mu.Lock()
+	if a.flows[f.key] == f {
+		delete(a.flows, f.key)
+	}
+	a.mu.Unlock()
+	f.conn.Close()
+}
@@ -0,0 +1,66 @@
+package clientlib
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/M-ERCURY/poc/socks"
+)
+
+func TestProxyUDPOrder(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	assocs := NewAssociations()
+	defer assocs.close(assocs.open(client.LocalAddr(), client.LocalAddr().String(), nil))
+	got := make(chan string, 100)
+	dialer := func(ctx context.Context, network, target string) (net.Conn, error) {
+		// slow enough for datagrams to pile up while dialing
+		time.Sleep(50 * time.Millisecond)
+		c, s := net.Pipe()
+		go func() {
+			b := make([]byte, 64)
+			for {
+				n, err := s.Read(b)
+				if err != nil {
+					return
+				}
+				got <- string(b[:n])
+			}
+		}()
+		return c, nil
+	}
+	go ProxyUDP(l, assocs, Isolation{}, nil, dialer, nil)
+	dst := socks.AddrAddr(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53})
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprint(i))
+		b, err := socks.ComposeUDP(dst, []byte(want[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = client.WriteTo(b, l.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, w := range want {
+		select {
+		case g := <-got:
+			if g != w {
+				t.Fatalf("datagram %d: got %q, expected %q", i, g, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("datagram %d: timed out", i)
+		}
+	}
+}
@@ -10,11 +10,14 @@ import (
 	"github.com/M-ERCURY/core/cli/commonsub/restartcmd"
 	"github.com/M-ERCURY/core/cli/commonsub/statuscmd"
 	"github.com/M-ERCURY/core/cli/commonsub/stopcmd"
+	"github.com/M-ERCURY/poc/sub/circuitcmd"
 	"github.com/M-ERCURY/poc/sub/configcmd"
 	"github.com/M-ERCURY/poc/sub/execcmd"
 	"github.com/M-ERCURY/poc/sub/infocmd"
 	"github.com/M-ERCURY/poc/sub/interceptcmd"
 	"github.com/M-ERCURY/poc/sub/startcmd"
+	"github.com/M-ERCURY/poc/sub/tracecmd"
+	"github.com/M-ERCURY/poc/sub/transparentcmd"
 	"github.com/M-ERCURY/poc/sub/tuncmd"
 )
 
@@ -34,6 +37,9 @@ func main() {
 			execcmd.Cmd(),
 			interceptcmd.Cmd(),
 			tuncmd.Cmd(),
+			transparentcmd.Cmd(),
+			circuitcmd.Cmd(),
+			tracecmd.Cmd(),
 			infocmd.Cmd(),
 			logcmd.Cmd(binname),
 		},
@@ -9,8 +9,13 @@ import (
 	"path"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/M-ERCURY/poc/filenames"
+	"github.com/M-ERCURY/poc/tun/fakeip"
+	"github.com/M-ERCURY/poc/tun/split"
 	"github.com/M-ERCURY/poc/tun/tun"
 	"github.com/fsnotify/fsnotify"
 	"github.com/vishvananda/netlink"
@@ -26,6 +31,7 @@ func main() {
 	sh := os.Getenv("MERCURY_HOME")
 	h2caddr := os.Getenv("MERCURY_ADDR_H2C")
 	tunaddr := os.Getenv("MERCURY_ADDR_TUN")
+	tun6 := os.Getenv("MERCURY_ADDR_TUN6")
 	if sh == "" || h2caddr == "" || tunaddr == "" {
 		log.Fatal("Running mercury_tun separately from mercury is not supported. Please use `sudo mercury tun start`.")
 	}
@@ -50,6 +56,11 @@ func main() {
 	if err != nil {
 		log.Fatalf("could not add bypass.json to file watcher: %s", err)
 	}
+	// split tunneling rules are reloaded with the config file
+	err = watcher.Add(path.Join(sh, filenames.Config))
+	if err != nil {
+		log.Fatalf("could not add %s to file watcher: %s", filenames.Config, err)
+	}
 
 	link, err := netlink.LinkByName(t.Name())
 	if err != nil {
@@ -75,20 +86,62 @@ func main() {
 	if err != nil {
 		log.Fatalf("could not set address of %s to %s: %s", link, addr, err)
 	}
-	// avoid clobbering the default route by being just a _little_ bit more specific
-	for _, r := range append([]netlink.Route{{
-		// lower half of all v4 addresses
-		LinkIndex: link.Attrs().Index,
-		Dst:       &net.IPNet{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(1, net.IPv4len*8)},
-	}, {
-		// upper half of all v4 addresses
-		LinkIndex: link.Attrs().Index,
-		Dst:       &net.IPNet{IP: net.IPv4(128, 0, 0, 0), Mask: net.CIDRMask(1, net.IPv4len*8)},
-	}, {
-		// v6 global-adressable range
-		LinkIndex: link.Attrs().Index,
-		Dst:       &net.IPNet{IP: net.ParseIP("2000::"), Mask: net.CIDRMask(3, net.IPv6len*8)},
-	}}, routes...) {
+	if tun6 != "" {
+		addr6, err := netlink.ParseAddr(tun6 + "/127")
+		if err != nil {
+			log.Fatalf("could not parse MERCURY_ADDR_TUN6 `%s`: %s", tun6, err)
+		}
+		err = netlink.AddrAdd(link, addr6)
+		if err != nil {
+			log.Fatalf("could not set address of %s to %s: %s", link, addr6, err)
+		}
+	}
+	// dns interception
+	var fakeroutes []netlink.Route
+	if os.Getenv("MERCURY_TUN_DNS") != "" {
+		var pool *fakeip.Pool
+		if fp := os.Getenv("MERCURY_TUN_FAKE_POOL"); fp != "" {
+			if pool, err = fakeip.New(strings.Split(fp, ",")); err != nil {
+				log.Fatalf("could not parse MERCURY_TUN_FAKE_POOL `%s`: %s", fp, err)
+			}
+			// fake addresses must reach the tun device whatever the other routes
+			for _, p := range pool.Prefixes() {
+				fakeroutes = append(fakeroutes, netlink.Route{
+					LinkIndex: link.Attrs().Index,
+					Dst:       &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen())},
+				})
+			}
+		}
+		dnsr = newResolver(h2caddr, os.Getenv("MERCURY_TUN_DNS_UPSTREAM"), pool)
+	}
+	// split tunneling; all traffic goes through mercury until the rules'
+	// hostnames are resolved and they are applied by the main loop
+	rules, err := getsplit(sh)
+	if err != nil {
+		log.Fatalf("could not get split rules: %s", err)
+	}
+	resolved := make(chan *split.Rules)
+	resolvesplit(rules, resolved)
+	tunroutes := splitroutes(link, nil)
+	// reroute replaces the catch-all routes with those of the current split
+	// rules, adding the new ones first so that no traffic leaks meanwhile
+	reroute := func() {
+		tunroutes2 := splitroutes(link, splitr.Load())
+		added := map[string]bool{}
+		for _, r := range tunroutes2 {
+			added[r.Dst.String()] = true
+			if err := netlink.RouteReplace(&r); err != nil {
+				log.Printf("could not add route to %s: %s", r.Dst, err)
+			}
+		}
+		for _, r := range tunroutes {
+			if !added[r.Dst.String()] {
+				netlink.RouteDel(&r)
+			}
+		}
+		tunroutes = tunroutes2
+	}
+	for _, r := range append(tunroutes, append(fakeroutes, routes...)...) {
 		log.Printf("adding route: %+v", r)
 		err = netlink.RouteReplace(&r)
 		if err != nil {
@@ -137,18 +190,40 @@ func main() {
 		}
 		runtime.SetMutexProfileFraction(n)
 	}
-	if err = tunsplice(t, h2caddr, tunaddr); err != nil {
-		log.Fatal("tunsplice returned error:", err)
+	switch mode := os.Getenv("MERCURY_TUN_STACK"); mode {
+	case "", "netstack":
+		err = netstack(t, h2caddr)
+	case "nat":
+		err = tunsplice(t, h2caddr, tunaddr)
+	default:
+		log.Fatalf("unknown MERCURY_TUN_STACK %s", mode)
 	}
+	if err != nil {
+		log.Fatalf("%s device forwarding returned error: %s", t.Name(), err)
+	}
+	// split rule hostnames are resolved again every so often
+	resolve := time.NewTicker(10 * time.Minute)
+	defer resolve.Stop()
 	for {
 		select {
 		case s := <-sig:
 			finalize()
 			log.Fatalf("terminating on signal %s", s)
-		case _, ok := <-watcher.Events:
+		case ev, ok := <-watcher.Events:
 			if !ok {
 				return
 			}
+			if path.Base(ev.Name) == filenames.Config {
+				rules2, err := getsplit(sh)
+				if err != nil {
+					// possibly read mid-write, the next event reloads it
+					log.Printf("could not reload split rules: %s", err)
+					continue
+				}
+				rules = rules2
+				resolvesplit(rules, resolved)
+				continue
+			}
 			routes2, err := getroutes(sh)
 			if err != nil {
 				log.Fatal(err)
@@ -163,6 +238,14 @@ func main() {
 				}
 			}
 			routes = routes2
+		case <-resolve.C:
+			resolvesplit(rules, resolved)
+		case r := <-resolved:
+			// rules replaced meanwhile are applied once they are resolved
+			if r == rules {
+				splitr.Store(r)
+				reroute()
+			}
 		case err, ok := <-watcher.Errors:
 			if !ok {
 				return
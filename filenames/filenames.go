@@ -1,14 +1,17 @@
 package filenames
 
 const (
-	Config     = "config.json"
-	Pid        = "mercury.pid"
-	Servicekey = "servicekey.json"
-	Pofs       = "pofs.json"
-	Log        = "mercury.log"
-	Bypass     = "bypass.json"
-	Contract   = "contract.json"
-	Relays     = "relays.json"
+	Config      = "config.json"
+	Pid         = "mercury.pid"
+	Servicekey  = "servicekey.json"
+	Pofs        = "pofs.json"
+	Log         = "mercury.log"
+	Bypass      = "bypass.json"
+	Contract    = "contract.json"
+	Relays      = "relays.json"
+	RelayStats  = "relay_stats.json"
+	RelayHealth = "relay_health.json"
+	Circuits    = "circuits.json"
 )
 
 var InitFiles = [...]string{Config, Servicekey, Pofs}
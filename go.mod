@@ -1,6 +1,8 @@
 module github.com/M-ERCURY/poc
 
-go 1.16
+// gvisor.dev/gvisor requires go 1.25.5; its older snapshots declaring a
+// lower version fail to build with go 1.26 and newer
+go 1.25.5
 
 require (
 	github.com/M-ERCURY/core v1.0.3
@@ -8,6 +10,17 @@ require (
 	github.com/fsnotify/fsnotify v1.7.0
 	github.com/google/gopacket v1.1.19
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
-	github.com/vishvananda/netlink v1.1.0
-	golang.org/x/net v0.21.0
+	github.com/vishvananda/netlink v1.1.1-0.20211118161826-650dca95af54
+	github.com/vishvananda/netns v0.0.0-20210104183010-2eb08e3e575f
+	golang.org/x/net v0.44.0
+	golang.org/x/sys v0.36.0
+	gvisor.dev/gvisor v0.0.0-20260122175437-89a5d21be8f0
+)
+
+require (
+	github.com/google/btree v1.1.3 // indirect
+	golang.org/x/crypto v0.42.0 // indirect
+	golang.org/x/exp v0.0.0-20241009180824-f66d83c29e7c // indirect
+	golang.org/x/text v0.29.0 // indirect
+	golang.org/x/time v0.12.0 // indirect
 )
@@ -17,6 +17,7 @@ static int (*o_connect)(int sockfd, const struct sockaddr *addr,
 		socklen_t addrlen);
 
 static struct addrinfo *proxy_info;
+static char *proxy_user, *proxy_pass;
 static char saved_node[256];
 
 /* Initializer, intercept functions and initialize the SOCKS proxy */
@@ -45,6 +46,43 @@ init(void)
 		proxy_port = MR_PORT;
 	}
 	o_getaddrinfo(proxy_addr, proxy_port, &hints, &proxy_info);
+
+	/* RFC 1929 credentials, if the proxy requires them */
+	proxy_user = getenv("SOCKS5_USER");
+	proxy_pass = getenv("SOCKS5_PASSWORD");
+	if (!proxy_pass)
+		proxy_pass = "";
+}
+
+/* Authenticate to the SOCKS proxy on sockfd */
+static int
+auth_proxy(int sockfd, char *buf, size_t buflen)
+{
+	size_t ulen, plen;
+
+	if (!proxy_user) {
+		send(sockfd, "\x05\x01\x00", 3, 0);
+		recv(sockfd, buf, 2, 0);
+		return memcmp(buf, "\x05\x00", 2) == 0 ? 0 : -1;
+	}
+
+	ulen = strlen(proxy_user);
+	plen = strlen(proxy_pass);
+	if (ulen > 255 || plen > 255 || 3+ulen+plen > buflen)
+		return -1;
+	send(sockfd, "\x05\x01\x02", 3, 0);
+	recv(sockfd, buf, 2, 0);
+	if (memcmp(buf, "\x05\x02", 2) != 0)
+		return -1;
+
+	buf[0] = 0x01;
+	buf[1] = (unsigned char)ulen;
+	memcpy(buf+2, proxy_user, ulen);
+	buf[2+ulen] = (unsigned char)plen;
+	memcpy(buf+3+ulen, proxy_pass, plen);
+	send(sockfd, buf, 3+ulen+plen, 0);
+	recv(sockfd, buf, 2, 0);
+	return memcmp(buf, "\x01\x00", 2) == 0 ? 0 : -1;
 }
 
 /* Intercepted getaddrinfo(3) */
@@ -84,9 +122,7 @@ connect_proxy(int sockfd, const struct sockaddr_in *addr, socklen_t addrlen)
 		return ret;
 	}
 
-	send(sockfd, "\x05\x01\x00", 3, 0);
-	recv(sockfd, buf, 2, 0);
-	if (memcmp(buf, "\x05\x00", 2) != 0) {
+	if (auth_proxy(sockfd, buf, sizeof(buf)) != 0) {
 		errno = ECONNREFUSED;
 		return -1;
 	}
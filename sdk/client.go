@@ -0,0 +1,419 @@
+// Package sdk embeds a mercury client in Go programs, dialing through
+// mercury circuits in-process instead of through the SOCKSv5 or h2c
+// listeners of a running daemon.
+package sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/M-ERCURY/core/api/auth"
+	"github.com/M-ERCURY/core/api/client"
+	"github.com/M-ERCURY/core/api/consume"
+	"github.com/M-ERCURY/core/api/contractinfo"
+	"github.com/M-ERCURY/core/api/dirinfo"
+	"github.com/M-ERCURY/core/api/relayentry"
+	"github.com/M-ERCURY/core/api/relaylist"
+	"github.com/M-ERCURY/core/api/status"
+	"github.com/M-ERCURY/core/cli/fsdir"
+	"github.com/M-ERCURY/core/mrnet/transport"
+	"github.com/M-ERCURY/poc/circuit"
+	"github.com/M-ERCURY/poc/clientcfg"
+	"github.com/M-ERCURY/poc/clientlib"
+	"github.com/M-ERCURY/poc/dnscachedial"
+	"github.com/M-ERCURY/poc/filenames"
+	"github.com/blang/semver"
+)
+
+// how often contract info is refreshed in the background
+const syncEvery = 15 * time.Minute
+
+// ErrClosed is returned when dialing through a closed Client.
+var ErrClosed = errors.New("mercury client closed")
+
+// Client dials targets through mercury circuits. Its state (servicekeys,
+// contract info, relay measurements and health) is kept in a mercury home
+// directory, so a Client can share a home with the mercury CLI.
+type Client struct {
+	fm    fsdir.T
+	cl    *client.Client
+	cache *dnscachedial.Control
+	// relay measurements for weighted selection
+	stats *circuit.Stats
+	// relay failures and quarantines
+	health *circuit.Health
+	pool   *circuit.Pool
+	dialer clientlib.DialFunc
+	http   *http.Transport
+
+	// protects config and contract info
+	mu  sync.Mutex
+	cfg clientcfg.C
+	ci  *contractinfo.T
+	rl  relaylist.T
+	di  dirinfo.T
+
+	done chan struct{}
+	once sync.Once
+}
+
+// New creates a Client from the configuration c and the mercury home
+// directory fm. It fetches contract information, makes sure a servicekey
+// can be obtained and waits for a first circuit to be built while warming up
+// the circuit pool in the background.
+//
+// Like the mercury daemon, a Client honors the MERCURY_TARGET_PROTOCOL
+// environment variable.
+func New(fm fsdir.T, c clientcfg.C) (*Client, error) {
+	mc := &Client{
+		fm:     fm,
+		cl:     client.New(nil, auth.Client),
+		cache:  dnscachedial.New(),
+		stats:  circuit.NewStats(),
+		health: circuit.NewHealth(),
+		cfg:    c,
+		done:   make(chan struct{}),
+	}
+	if err := fm.Get(mc.stats, filenames.RelayStats); err != nil {
+		log.Printf("no previous relay measurements loaded: %s", err)
+	}
+	if err := fm.Get(mc.health, filenames.RelayHealth); err != nil {
+		log.Printf("no previous relay health state loaded: %s", err)
+	}
+
+	tt := transport.New(transport.Options{Timeout: time.Duration(c.Timeout)})
+	// cache dns resolution in netstack transport
+	tt.Transport.DialContext = mc.cache.Cover(tt.Transport.DialContext)
+	tt.Transport.DialTLSContext = mc.cache.Cover(tt.Transport.DialTLSContext)
+	mc.cl.Transport = tt.Transport
+	dialf := clientlib.DialSMContext(tt)
+	// force target protocol if needed
+	if tproto, ok := os.LookupEnv("MERCURY_TARGET_PROTOCOL"); ok {
+		dialsm := dialf
+		dialf = func(ctx context.Context, proto string, remote *url.URL) (net.Conn, error) {
+			if remote.Scheme == "target" {
+				proto = tproto
+			}
+			return dialsm(ctx, proto, remote)
+		}
+	}
+
+	if c.Contract != nil {
+		if err := mc.syncinfo(); err != nil {
+			return nil, err
+		}
+		mc.probe()
+		// cache all relay addresses just in case
+		for _, r := range mc.rl.All() {
+			if err := mc.cache.Cache(context.Background(), r.Addr.Hostname()); err != nil {
+				log.Printf("could not cache %s: %s", r.Addr.Hostname(), err)
+			}
+		}
+	}
+	if _, err := clientlib.ValidateAndRecievePofs(fm); err != nil {
+		log.Printf("could not validate pofs: %s", err)
+		// update servicekey
+		if err := clientlib.UpdateServiceKey(fm, c.PofURL); err != nil {
+			return nil, fmt.Errorf("could not update servicekey: %w", err)
+		}
+	}
+	sks := clientlib.SKSource(fm, &mc.cfg, mc.cl)
+
+	// warm up circuits in background; builds wait for the pool to be set
+	mc.mu.Lock()
+	pool, err := circuit.NewPool(circuit.PoolOptions{
+		Size:       c.Circuit.PoolSize,
+		Policy:     c.Circuit.PoolPolicy,
+		Stats:      mc.stats,
+		MaxAge:     time.Duration(c.Circuit.MaxAge),
+		MaxStreams: c.Circuit.MaxStreams,
+		Changed: func() {
+			mc.mu.Lock()
+			defer mc.mu.Unlock()
+			if err := mc.expose(mc.pool.Circuits()); err != nil {
+				log.Printf("could not expose circuits: %s", err)
+			}
+		},
+	}, mc.build)
+	mc.pool = pool
+	mc.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	go mc.refresh()
+	// wait for the first build attempt, later ones are retried
+	if t, err := pool.Get(""); err != nil {
+		log.Printf("could not build circuit: %s", err)
+	} else {
+		pool.Done(t)
+	}
+	dopts := clientlib.DialOptions{
+		Stats:    mc.stats,
+		Attempts: c.Circuit.DialAttempts,
+		Timeout:  time.Duration(c.Circuit.DialTimeout),
+		Retry:    pool.Replace,
+		Failed:   mc.report,
+		Done:     pool.Done,
+	}
+	mc.dialer = clientlib.CircuitDialer(clientlib.AlwaysFetch(sks), pool.Get, dialf, dopts)
+	mc.http = &http.Transport{
+		DialContext:         mc.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return mc, nil
+}
+
+// syncinfo fetches and saves contract and directory info. Callers must hold
+// mu unless the client is not running yet.
+func (mc *Client) syncinfo() (err error) {
+	c := mc.cfg.Contract
+	if c == nil {
+		return fmt.Errorf("contract is not defined")
+	}
+	if mc.ci, mc.rl, err = clientlib.GetContractInfo(mc.cl, c); err != nil {
+		return fmt.Errorf("could not get contract info: %w", err)
+	}
+	if mc.di, err = consume.DirectoryInfo(mc.cl, c); err != nil {
+		return fmt.Errorf("could not get contract directory info: %w", err)
+	}
+	if err = clientlib.SaveContractInfo(mc.fm, mc.ci, mc.rl); err != nil {
+		return fmt.Errorf("could not save contract info: %w", err)
+	}
+	return nil
+}
+
+// probe refreshes relay measurements in the background. Callers must hold mu
+// unless the client is not running yet.
+func (mc *Client) probe() {
+	if mc.cfg.Circuit.Selection != circuit.SelectWeighted || mc.rl == nil {
+		return
+	}
+	go func(all circuit.T, timeout time.Duration) {
+		mc.stats.Probe(all, timeout)
+		if err := mc.fm.Set(mc.stats, filenames.RelayStats); err != nil {
+			log.Printf("could not save relay measurements: %s", err)
+		}
+	}(mc.rl.All(), time.Duration(mc.cfg.Timeout))
+}
+
+// refresh keeps contract info fresh without stalling circuit builds.
+func (mc *Client) refresh() {
+	t := time.NewTicker(syncEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-mc.done:
+			return
+		case <-t.C:
+		}
+		mc.mu.Lock()
+		if err := mc.syncinfo(); err != nil {
+			log.Printf("could not refresh contract info: %s", err)
+		} else {
+			mc.probe()
+		}
+		mc.mu.Unlock()
+	}
+}
+
+// build makes a new circuit without the relays in exclude.
+func (mc *Client) build(exclude circuit.T) (r circuit.T, err error) {
+	// avoid racing with contract info and config reloads
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	c, rl := &mc.cfg, mc.rl
+	var all circuit.T
+	if c.Circuit.Whitelist != nil {
+		if len(*c.Circuit.Whitelist) > 0 {
+			for _, addr := range *c.Circuit.Whitelist {
+				if rl[addr] != nil {
+					all = append(all, rl[addr])
+				}
+			}
+		}
+	} else {
+		all = rl.All()
+	}
+	pick, err := circuit.NewPicker(c.Circuit.Selection, mc.stats)
+	if err != nil {
+		return nil, err
+	}
+	blacklist := map[*relayentry.T]bool{}
+	if c.Circuit.Blacklist != nil {
+		for _, addr := range *c.Circuit.Blacklist {
+			if rl[addr] != nil {
+				blacklist[rl[addr]] = true
+			}
+		}
+	}
+	// quarantined relays allowed for lack of others
+	allow := map[*relayentry.T]bool{}
+	skip := func(r *relayentry.T) bool {
+		return blacklist[r] || exclude.Contains(r) || (mc.health.Quarantined(r) && !allow[r])
+	}
+	diversity := &circuit.Diversity{
+		Subnet4: c.Circuit.Diversity.Subnet4,
+		Subnet6: c.Circuit.Diversity.Subnet6,
+		Host:    c.Circuit.Diversity.Host,
+		Lookup: func(host string) ([]string, error) {
+			if addrs := mc.cache.Get(host); addrs != nil {
+				return addrs, nil
+			}
+			return net.LookupHost(host)
+		},
+	}
+	opts := circuit.Options{Pick: pick, Skip: skip, Diversity: diversity}
+	if r, err = circuit.MakeWith(c.Circuit.Hops, all, opts); err != nil {
+		// rather than failing until quarantines end, fall back to the
+		// quarantined relays which failed least recently
+		for _, q := range mc.health.LeastRecentlyFailed(all) {
+			if blacklist[q] || exclude.Contains(q) {
+				continue
+			}
+			allow[q] = true
+			if r, err = circuit.MakeWith(c.Circuit.Hops, all, opts); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return
+		}
+		for _, q := range r {
+			if allow[q] {
+				log.Printf("not enough relays out of quarantine, using quarantined relay %s", q.Pubkey)
+			}
+		}
+	}
+	// the new circuit's relays must be bypassed before it is used
+	err = mc.expose(append(mc.pool.Circuits(), r))
+	return
+}
+
+// expose writes the bypass addresses for mercury_tun and the circuits for
+// mercury trace of the circuits circs. Callers must hold mu.
+func (mc *Client) expose(circs []circuit.T) error {
+	var bypass []string
+	if c := mc.cfg.Contract; c != nil {
+		bypass = append(bypass, mc.cache.Get(c.Hostname())...)
+	}
+	if e := mc.di.Endpoint; e != nil {
+		bypass = append(bypass, mc.cache.Get(e.Hostname())...)
+	}
+	for _, t := range circs {
+		if len(t) > 0 {
+			bypass = append(bypass, mc.cache.Get(t[0].Addr.Hostname())...)
+		}
+	}
+	if err := mc.fm.Set(bypass, filenames.Bypass); err != nil {
+		return err
+	}
+	return mc.fm.Set(circs, filenames.Circuits)
+}
+
+// report handles a dial error: relays which caused circuit errors are
+// quarantined and their circuits replaced.
+func (mc *Client) report(e error) {
+	if o := clientlib.TraceOrigin(e, mc.pool.Relays()); o != nil {
+		if status.IsCircuitError(e) {
+			// reset on circuit errors
+			log.Printf(
+				"relay-originated circuit error from %s: %s, replacing its circuits",
+				o.Pubkey,
+				e,
+			)
+			mc.health.Fail(o, e)
+			if err := mc.fm.Set(mc.health, filenames.RelayHealth); err != nil {
+				log.Printf("could not save relay health state: %s", err)
+			}
+			mc.pool.Drop(o)
+		} else {
+			// not reset-worthy
+			log.Printf("error from %s: %s", o.Pubkey, e)
+		}
+	} else {
+		log.Printf("circuit dial error: %s", e)
+	}
+}
+
+// Dial connects to address on the named network ("tcp", "tcp4", "tcp6",
+// "udp", "udp4" or "udp6") through a mercury circuit.
+func (mc *Client) Dial(network, address string) (net.Conn, error) {
+	return mc.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address on the named network through a mercury
+// circuit. Streams are isolated by the key set with
+// clientlib.WithIsolationKey on ctx, and the dial is traced by the trace set
+// with clientlib.WithDialTrace. Canceling ctx aborts the dial.
+func (mc *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	select {
+	case <-mc.done:
+		return nil, ErrClosed
+	default:
+	}
+	c, err := mc.dialer(ctx, network, address)
+	if err != nil {
+		mc.report(err)
+		return nil, err
+	}
+	return c, nil
+}
+
+// RoundTrip implements http.RoundTripper, sending HTTP requests through
+// mercury circuits.
+func (mc *Client) RoundTrip(r *http.Request) (*http.Response, error) {
+	return mc.http.RoundTrip(r)
+}
+
+// UpdateChannels returns the latest mercury versions per update channel
+// advertised by the contract directory.
+func (mc *Client) UpdateChannels() map[string]semver.Version {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.di.Channels
+}
+
+// Reload applies configuration c, refreshes contract info and replaces all
+// circuits. Circuit pool size and policy, dial retries and the servicekey
+// source keep their previous configuration.
+func (mc *Client) Reload(c clientcfg.C) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.cfg = c
+	// refresh contract info
+	if err := mc.syncinfo(); err != nil {
+		return err
+	}
+	// reset circuits
+	mc.pool.SetRotation(time.Duration(c.Circuit.MaxAge), c.Circuit.MaxStreams)
+	mc.pool.Reset()
+	return nil
+}
+
+// Rotate switches new connections to fresh circuits, letting existing ones
+// finish on the old circuits.
+func (mc *Client) Rotate() { mc.pool.Rotate() }
+
+// Close stops building circuits and saves relay measurements. Connections
+// already established are not closed.
+func (mc *Client) Close() error {
+	var err error
+	mc.once.Do(func() {
+		close(mc.done)
+		mc.pool.Close()
+		mc.http.CloseIdleConnections()
+		err = mc.fm.Set(mc.stats, filenames.RelayStats)
+	})
+	return err
+}
@@ -0,0 +1,163 @@
+package sdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/M-ERCURY/core/cli/fsdir"
+	"github.com/M-ERCURY/poc/circuit"
+	"github.com/M-ERCURY/poc/clientlib"
+)
+
+// dialer stands in for the circuit dialer: what is written to its
+// connections is echoed back prefixed with the target, and dials fail with
+// err if set.
+type dialer struct {
+	mu    sync.Mutex
+	dials []string
+	err   error
+}
+
+func (d *dialer) dial(ctx context.Context, network, target string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials = append(d.dials, fmt.Sprintf("%s %s %q", network, target, clientlib.IsolationKey(ctx)))
+	if d.err != nil {
+		return nil, d.err
+	}
+	c, s := net.Pipe()
+	go func() {
+		defer s.Close()
+		b := make([]byte, maxDatagram)
+		for {
+			n, err := s.Read(b)
+			if err != nil {
+				return
+			}
+			if _, err = s.Write(append([]byte(target+" "), b[:n]...)); err != nil {
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func (d *dialer) calls() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.dials...)
+}
+
+// newClient returns a Client dialing through d, with a pool that builds no
+// circuits.
+func newClient(t *testing.T, d *dialer) *Client {
+	fm, err := fsdir.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := circuit.NewPool(circuit.PoolOptions{}, func(circuit.T) (circuit.T, error) {
+		return nil, errors.New("no relays")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := &Client{
+		fm:     fm,
+		stats:  circuit.NewStats(),
+		health: circuit.NewHealth(),
+		pool:   pool,
+		dialer: d.dial,
+		http:   &http.Transport{},
+		done:   make(chan struct{}),
+	}
+	t.Cleanup(func() { mc.Close() })
+	return mc
+}
+
+func TestDialContext(t *testing.T) {
+	d := &dialer{}
+	mc := newClient(t, d)
+	ctx := clientlib.WithIsolationKey(context.Background(), "key")
+	c, err := mc.DialContext(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	d.err = errors.New("dial failed")
+	if _, err = mc.DialContext(ctx, "tcp", "example.com:81"); err != d.err {
+		t.Fatalf("got %v, expected %v", err, d.err)
+	}
+	got, want := fmt.Sprint(d.calls()), `[tcp example.com:80 "key" tcp example.com:81 "key"]`
+	if got != want {
+		t.Errorf("got dials %s, expected %s", got, want)
+	}
+}
+
+func TestListenPacket(t *testing.T) {
+	d := &dialer{}
+	mc := newClient(t, d)
+	if _, err := mc.ListenPacket(context.Background(), "tcp"); err == nil {
+		t.Fatal("expected an error for tcp")
+	}
+	pc, err := mc.ListenPacket(clientlib.WithIsolationKey(context.Background(), "key"), "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	b := make([]byte, 64)
+	for _, to := range []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.1:53"} {
+		if _, err = pc.WriteTo([]byte("ping"), &Addr{Net: "udp", Host: to}); err != nil {
+			t.Fatal(err)
+		}
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := pc.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from.String() != to || string(b[:n]) != to+" ping" {
+			t.Fatalf("got %q from %s, expected the echo from %s", b[:n], from, to)
+		}
+	}
+	// one circuit connection per destination
+	got, want := fmt.Sprint(d.calls()), `[udp 192.0.2.1:53 "key" udp 192.0.2.2:53 "key"]`
+	if got != want {
+		t.Errorf("got dials %s, expected %s", got, want)
+	}
+	pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err = pc.ReadFrom(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, expected a timeout", err)
+	}
+	pc.Close()
+	if _, err = pc.WriteTo([]byte("ping"), &Addr{Net: "udp", Host: "192.0.2.1:53"}); err != net.ErrClosed {
+		t.Fatalf("got %v after close, expected %v", err, net.ErrClosed)
+	}
+}
+
+func TestClose(t *testing.T) {
+	d := &dialer{}
+	mc := newClient(t, d)
+	pc, err := mc.ListenPacket(context.Background(), "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if err = mc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mc.DialContext(context.Background(), "tcp", "example.com:80"); err != ErrClosed {
+		t.Fatalf("got %v, expected %v", err, ErrClosed)
+	}
+	if _, err = pc.WriteTo([]byte("ping"), &Addr{Net: "udp", Host: "192.0.2.1:53"}); err != ErrClosed {
+		t.Fatalf("got %v from a packet conn, expected %v", err, ErrClosed)
+	}
+	if len(d.calls()) != 0 {
+		t.Errorf("dialed %v after close", d.calls())
+	}
+}
@@ -0,0 +1,200 @@
+package sdk
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// largest datagram read from a circuit
+const maxDatagram = 65535
+
+// Addr is the address of a datagram sent through a circuit: an unresolved
+// host:port, resolved by the exit relay.
+type Addr struct {
+	Net  string
+	Host string
+}
+
+func (a *Addr) Network() string { return a.Net }
+func (a *Addr) String() string  { return a.Host }
+
+// datagram is a datagram received from addr.
+type datagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+// packetConn is a net.PacketConn sending datagrams through circuits, dialing
+// one circuit connection per destination address.
+type packetConn struct {
+	ctx     context.Context
+	network string
+	mc      *Client
+	in      chan datagram
+
+	mu       sync.Mutex
+	conns    map[string]net.Conn
+	deadline time.Time
+	// signaled on read deadline changes
+	dlc  chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// ListenPacket returns a net.PacketConn sending UDP datagrams through mercury
+// circuits, using a circuit connection per destination. The network is "udp",
+// "udp4" or "udp6". ctx is used for the dials of every destination, so it can
+// carry an isolation key; canceling it aborts pending dials.
+func (mc *Client) ListenPacket(ctx context.Context, network string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	return &packetConn{
+		ctx:     ctx,
+		network: network,
+		mc:      mc,
+		in:      make(chan datagram),
+		conns:   map[string]net.Conn{},
+		dlc:     make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// conn returns the circuit connection to addr, dialing it if needed.
+func (c *packetConn) conn(addr string) (net.Conn, error) {
+	c.mu.Lock()
+	cc := c.conns[addr]
+	c.mu.Unlock()
+	if cc != nil {
+		return cc, nil
+	}
+	cc, err := c.mc.DialContext(c.ctx, c.network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		cc.Close()
+		return nil, net.ErrClosed
+	default:
+	}
+	if cc0 := c.conns[addr]; cc0 != nil {
+		// lost a race with a concurrent write
+		cc.Close()
+		return cc0, nil
+	}
+	c.conns[addr] = cc
+	go c.read(cc, &Addr{Net: c.network, Host: addr})
+	return cc, nil
+}
+
+// read forwards datagrams received on cc until it fails.
+func (c *packetConn) read(cc net.Conn, addr *Addr) {
+	defer func() {
+		c.mu.Lock()
+		if c.conns[addr.Host] == cc {
+			delete(c.conns, addr.Host)
+		}
+		c.mu.Unlock()
+		cc.Close()
+	}()
+	for {
+		b := make([]byte, maxDatagram)
+		n, err := cc.Read(b)
+		if err != nil {
+			return
+		}
+		select {
+		case c.in <- datagram{b[:n], addr}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		dl := c.deadline
+		c.mu.Unlock()
+		var (
+			t       *time.Timer
+			timeout <-chan time.Time
+		)
+		if !dl.IsZero() {
+			d := time.Until(dl)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			t = time.NewTimer(d)
+			timeout = t.C
+		}
+		select {
+		case d := <-c.in:
+			if t != nil {
+				t.Stop()
+			}
+			return copy(p, d.b), d.addr, nil
+		case <-c.done:
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-c.dlc:
+			// deadline changed
+			if t != nil {
+				t.Stop()
+			}
+		}
+	}
+}
+
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	cc, err := c.conn(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return cc.Write(p)
+}
+
+func (c *packetConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		for _, cc := range c.conns {
+			cc.Close()
+		}
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr { return &Addr{Net: c.network} }
+
+func (c *packetConn) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	select {
+	case c.dlc <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline is a no-op: writes only block while dialing, which is
+// bounded by the dial timeout.
+func (c *packetConn) SetWriteDeadline(t time.Time) error { return nil }
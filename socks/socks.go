@@ -1,5 +1,5 @@
 // Package socks provides a barebones SOCKSv5 server handshake protocol
-// implementation.
+// implementation, with SOCKS4 and SOCKS4a compatibility.
 package socks
 
 import (
@@ -22,8 +22,23 @@ const (
 	ADDR_IPV6 = 0x04
 
 	RSV = 0x00
+
+	AUTH_NONE         = 0x00
+	AUTH_USERPASS     = 0x02
+	AUTH_UNACCEPTABLE = 0xff
+
+	USERPASS_VERSION = 0x01
 )
 
+// Credentials are RFC 1929 username/password credentials.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Authenticator reports whether creds are valid.
+type Authenticator func(creds *Credentials) bool
+
 type SocksStatus byte
 
 func (e SocksStatus) Error() string {
@@ -78,6 +93,10 @@ func AddrString(addr string) (r Addr, err error) {
 	ip := net.ParseIP(host)
 	if ip == nil {
 		// probably fqdn
+		if len(host) == 0 || len(host) > 255 {
+			err = fmt.Errorf("invalid SOCKS fqdn address %q", host)
+			return
+		}
 		r = append(r, ADDR_FQDN)
 		r = append(r, byte(len(host)))
 		r = append(r, []byte(host)...)
@@ -96,16 +115,24 @@ func AddrString(addr string) (r Addr, err error) {
 	if err != nil {
 		return
 	}
+	if port < 0 || port > 0xffff {
+		err = fmt.Errorf("invalid SOCKS address port %d", port)
+		return
+	}
 	r = append(r, []byte{byte(port >> 8), byte(port)}...)
 	return
 }
 
+// AddrAddr returns the address of a TCP or UDP endpoint, 0.0.0.0:0 for any
+// other kind of endpoint such as a unix socket.
 func AddrAddr(orig net.Addr) (r Addr) {
 	switch v := orig.(type) {
 	case *net.TCPAddr:
 		r = AddrIPPort(v.IP, v.Port)
 	case *net.UDPAddr:
 		r = AddrIPPort(v.IP, v.Port)
+	default:
+		r = AddrIPPort(net.IPv4zero, 0)
 	}
 	return
 }
@@ -114,10 +141,12 @@ func (t Addr) String() string {
 	if ip, port := t.IPPort(); ip != nil {
 		return net.JoinHostPort(ip.String(), strconv.Itoa(port))
 	}
-	if len(t) < 2 || len(t) < int(2+t[1]+2) {
+	if len(t) < 2 || t[0] != ADDR_FQDN || len(t) < 2+int(t[1])+2 {
 		return ""
 	}
-	return string(t[2 : t[1]+2]) // fqdn
+	n := 2 + int(t[1])
+	port := int(t[n])<<8 | int(t[n+1])
+	return net.JoinHostPort(string(t[2:n]), strconv.Itoa(port)) // fqdn
 }
 
 func (t Addr) IPPort() (ip net.IP, port int) {
@@ -136,44 +165,53 @@ func (t Addr) IPPort() (ip net.IP, port int) {
 	return
 }
 
-func ComposeUDP(srcaddr, dstaddr Addr, p []byte) (r []byte, err error) {
-	// RSV, RSV, FRAG
-	r = []byte{0, 0, 0}
-	// ATYP, ADDR, PORT
-	r = append(r, srcaddr...)
-	// ATYP, ADDR, PORT
-	r = append(r, dstaddr...)
-	// DATA
-	r = append(r, p...)
-	return
-}
-
-func DissectUDP(p []byte) (srcaddr Addr, dstaddr Addr, data []byte) {
-	// RSV, RSV, FRAG ignored
-	// ATYP
-	switch p[3] {
-	case ADDR_IPV4, ADDR_IPV6:
-		mult := p[3]
-		// ATYP + (1 or 4) * 4 + PORT
-		srcaddr = make([]byte, 1+mult*4+2)
-		copy(srcaddr, p[3:])
-		// ATYP + (1 or 4) * 4 + PORT
-		dstaddr = make([]byte, 1+mult*4+2)
-		copy(dstaddr, p[3+len(srcaddr):])
-		data = p[3+len(srcaddr)+len(dstaddr):]
-	case ADDR_FQDN:
-		// SIZE
-		size := p[4]
-		srcaddr = make([]byte, 2+size+2)
-		copy(srcaddr, p[3:])
-		dstaddr = make([]byte, 2+size+2)
-		copy(srcaddr, p[3+len(srcaddr):])
-		data = p[2+len(srcaddr)+len(dstaddr):]
+// readUserPass performs the RFC 1929 username/password sub-negotiation,
+// accepting any credentials if auth is nil.
+func readUserPass(c net.Conn, auth Authenticator) (creds *Credentials, err error) {
+	b := make([]byte, 1)
+	// sub-negotiation version
+	_, err = io.ReadFull(c, b)
+	if err != nil {
+		return
+	}
+	if b[0] != USERPASS_VERSION {
+		err = fmt.Errorf("unknown SOCKS username/password auth version: 0x%x", b)
+		return
+	}
+	creds = &Credentials{}
+	for _, v := range []*string{&creds.Username, &creds.Password} {
+		// length
+		_, err = io.ReadFull(c, b)
+		if err != nil {
+			return
+		}
+		// value
+		p := make([]byte, b[0])
+		_, err = io.ReadFull(c, p)
+		if err != nil {
+			return
+		}
+		*v = string(p)
+	}
+	if auth != nil && !auth(creds) {
+		c.Write([]byte{USERPASS_VERSION, 0x01})
+		err = fmt.Errorf("SOCKS authentication failed for user %q", creds.Username)
+		return
 	}
+	// tell the client auth succeeded
+	_, err = c.Write([]byte{USERPASS_VERSION, 0x00})
 	return
 }
 
-func Handshake(c net.Conn) (cmd byte, address string, err error) {
+// Handshake performs the server side of a SOCKSv5 handshake and returns the
+// requested command and address. If auth is not nil, clients must
+// authenticate with username/password credentials accepted by auth.
+// Otherwise username/password authentication is only used if the client
+// offers it, accepting any credentials. The client's credentials are returned
+// if it authenticated. SOCKS4 and SOCKS4a CONNECT requests are also accepted;
+// ver is the client's SOCKS version, replies to SOCKS4 clients must be written
+// with WriteStatus4.
+func Handshake(c net.Conn, auth Authenticator) (ver, cmd byte, address string, creds *Credentials, err error) {
 	b := make([]byte, 1)
 	// read auth methods
 	// SOCKS version
@@ -181,7 +219,12 @@ func Handshake(c net.Conn) (cmd byte, address string, err error) {
 	if err != nil {
 		return
 	}
-	if b[0] != SOCKSv5 {
+	ver = b[0]
+	if ver == SOCKSv4 {
+		cmd, address, creds, err = handshake4(c, auth)
+		return
+	}
+	if ver != SOCKSv5 {
 		WriteStatus(c, StatusGeneralFailure, AddrAddr(c.LocalAddr()))
 		err = fmt.Errorf("unknown SOCKS auth version: 0x%x", b)
 		return
@@ -192,15 +235,30 @@ func Handshake(c net.Conn) (cmd byte, address string, err error) {
 		return
 	}
 	methods := make([]byte, b[0])
-	// auth methods -- don't care which ones as no auth is required
+	// auth methods -- username/password is required with auth, otherwise it
+	// is used for stream isolation if offered
 	_, err = io.ReadFull(c, methods)
 	if err != nil {
 		return
 	}
-	// tell the client no auth is needed
-	_, err = c.Write([]byte{0x05, 0x00})
-	if err != nil {
+	if bytes.IndexByte(methods, AUTH_USERPASS) != -1 {
+		_, err = c.Write([]byte{SOCKSv5, AUTH_USERPASS})
+		if err != nil {
+			return
+		}
+		if creds, err = readUserPass(c, auth); err != nil {
+			return
+		}
+	} else if auth != nil {
+		c.Write([]byte{SOCKSv5, AUTH_UNACCEPTABLE})
+		err = fmt.Errorf("SOCKS client did not offer username/password authentication")
 		return
+	} else {
+		// tell the client no auth is needed
+		_, err = c.Write([]byte{SOCKSv5, AUTH_NONE})
+		if err != nil {
+			return
+		}
 	}
 	// read request
 	// SOCKS version
@@ -0,0 +1,101 @@
+package socks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	SOCKSv4 = 0x04
+
+	// SOCKS4 reply version and codes
+	REPLY4_VERSION  = 0x00
+	REPLY4_GRANTED  = 0x5a
+	REPLY4_REJECTED = 0x5b
+
+	// longest accepted SOCKS4 user id or SOCKS4a hostname
+	maxString4 = 255
+)
+
+// WriteStatus4 writes a SOCKS4 reply. Any status other than StatusOK is
+// reported as rejected; addresses which are not IPv4 are sent as 0.0.0.0:0.
+func WriteStatus4(c net.Conn, status SocksStatus, addr Addr) (int, error) {
+	r := []byte{REPLY4_VERSION, REPLY4_REJECTED, 0, 0, 0, 0, 0, 0}
+	if status == StatusOK {
+		r[1] = REPLY4_GRANTED
+	}
+	if ip, port := addr.IPPort(); ip != nil && ip.To4() != nil {
+		binary.BigEndian.PutUint16(r[2:], uint16(port))
+		copy(r[4:], ip.To4())
+	}
+	return c.Write(r)
+}
+
+// handshake4 performs the server side of a SOCKS4 or SOCKS4a handshake once
+// the version byte was read. Only CONNECT is supported. SOCKS4 cannot carry
+// passwords, so clients are rejected if auth is not nil; otherwise a non-empty
+// user id is returned as the username of the client's credentials.
+func handshake4(c net.Conn, auth Authenticator) (cmd byte, address string, creds *Credentials, err error) {
+	// CD, DSTPORT, DSTIP
+	b := make([]byte, 7)
+	if _, err = io.ReadFull(c, b); err != nil {
+		return
+	}
+	cmd = b[0]
+	port := binary.BigEndian.Uint16(b[1:3])
+	ip := net.IP(b[3:7])
+	// USERID
+	userid, err := readString4(c)
+	if err != nil {
+		return
+	}
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		// SOCKS4a: 0.0.0.x means the hostname follows
+		if host, err = readString4(c); err != nil {
+			return
+		}
+		if host == "" {
+			WriteStatus4(c, StatusGeneralFailure, nil)
+			err = fmt.Errorf("empty SOCKS4a hostname")
+			return
+		}
+	}
+	if cmd != CONNECT {
+		WriteStatus4(c, StatusCommandNotSupported, nil)
+		err = fmt.Errorf("unsupported SOCKS4 command %d", cmd)
+		return
+	}
+	if auth != nil {
+		WriteStatus4(c, StatusNotAllowed, nil)
+		err = fmt.Errorf("SOCKS4 client %q cannot authenticate with a password", userid)
+		return
+	}
+	if userid != "" {
+		creds = &Credentials{Username: userid}
+	}
+	address = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return
+}
+
+// readString4 reads a NUL-terminated string of at most maxString4 bytes, one
+// byte at a time so that no data past the request is consumed.
+func readString4(c io.Reader) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(c, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) == maxString4 {
+			return "", fmt.Errorf("SOCKS4 string longer than %d bytes", maxString4)
+		}
+		s = append(s, b[0])
+	}
+}
@@ -0,0 +1,189 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// FRAG_END marks the last fragment of a fragmented UDP datagram.
+	FRAG_END = 0x80
+
+	// largest reassembled UDP datagram
+	maxDatagram = 65535
+)
+
+// DefaultFragTimeout is the minimum reassembly timeout of RFC 1928.
+const DefaultFragTimeout = 5 * time.Second
+
+var (
+	// ErrShortDatagram is returned for UDP datagrams too short to hold a
+	// SOCKS UDP request header.
+	ErrShortDatagram = errors.New("SOCKS udp datagram too short")
+	// ErrAddrType is returned for unknown address types.
+	ErrAddrType = errors.New("SOCKS address type not supported")
+)
+
+// ParseAddr parses the ATYP, ADDR, PORT address at the start of p and returns
+// it and the rest of p.
+func ParseAddr(p []byte) (addr Addr, rest []byte, err error) {
+	if len(p) < 1 {
+		return nil, nil, ErrShortDatagram
+	}
+	var n int
+	switch p[0] {
+	case ADDR_IPV4:
+		n = 1 + 4 + 2
+	case ADDR_IPV6:
+		n = 1 + 16 + 2
+	case ADDR_FQDN:
+		if len(p) < 2 {
+			return nil, nil, ErrShortDatagram
+		}
+		if p[1] == 0 {
+			return nil, nil, fmt.Errorf("empty SOCKS fqdn address")
+		}
+		n = 2 + int(p[1]) + 2
+	default:
+		return nil, nil, ErrAddrType
+	}
+	if len(p) < n {
+		return nil, nil, ErrShortDatagram
+	}
+	return Addr(p[:n:n]), p[n:], nil
+}
+
+// ComposeUDP returns an unfragmented RFC 1928 UDP datagram carrying p from or
+// to addr.
+func ComposeUDP(addr Addr, p []byte) (r []byte, err error) {
+	_, rest, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("trailing data after SOCKS address")
+	}
+	r = make([]byte, 0, 3+len(addr)+len(p))
+	// RSV, RSV, FRAG
+	r = append(r, RSV, RSV, 0)
+	// ATYP, DST.ADDR, DST.PORT
+	r = append(r, addr...)
+	// DATA
+	r = append(r, p...)
+	return
+}
+
+// DissectUDP parses an RFC 1928 UDP datagram into its fragment number,
+// destination address and data. data and addr point into p.
+func DissectUDP(p []byte) (frag byte, addr Addr, data []byte, err error) {
+	// RSV, RSV, FRAG
+	if len(p) < 4 {
+		return 0, nil, nil, ErrShortDatagram
+	}
+	if p[0] != RSV || p[1] != RSV {
+		return 0, nil, nil, fmt.Errorf("invalid SOCKS udp reserved bytes 0x%x", p[:2])
+	}
+	frag = p[2]
+	if frag&^FRAG_END == 0 && frag != 0 {
+		return 0, nil, nil, fmt.Errorf("invalid SOCKS udp fragment number 0x%x", frag)
+	}
+	// ATYP, DST.ADDR, DST.PORT
+	addr, data, err = ParseAddr(p[3:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return
+}
+
+// Reassembler reassembles fragmented UDP datagrams, keeping one queue per
+// client address. Queues are abandoned once their timeout expires, when a
+// fragment arrives out of order, when the destination changes or when an
+// unfragmented datagram arrives, as RFC 1928 requires.
+type Reassembler struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	queues map[string]*fragQueue
+}
+
+// fragQueue is the reassembly queue of a client.
+type fragQueue struct {
+	addr  Addr
+	last  byte
+	data  []byte
+	timer *time.Timer
+}
+
+// NewReassembler creates a reassembler abandoning incomplete datagrams after
+// timeout.
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{timeout: timeout, queues: map[string]*fragQueue{}}
+}
+
+// Add queues a datagram from client as returned by DissectUDP. It returns the
+// destination and data of the reassembled datagram once it is complete;
+// unfragmented datagrams are returned as they are.
+func (r *Reassembler) Add(client string, frag byte, addr Addr, data []byte) (Addr, []byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	q := r.queues[client]
+	if frag == 0 {
+		// a standalone datagram abandons the pending queue
+		if q != nil {
+			r.drop(client, q)
+		}
+		return addr, data, true
+	}
+	pos := frag &^ FRAG_END
+	if q != nil && (pos <= q.last || string(addr) != string(q.addr)) {
+		r.drop(client, q)
+		q = nil
+	}
+	if q == nil {
+		if pos != 1 {
+			// missed the start of the datagram
+			return nil, nil, false
+		}
+		q = &fragQueue{addr: append(Addr(nil), addr...)}
+		q.timer = time.AfterFunc(r.timeout, func() {
+			r.mu.Lock()
+			if r.queues[client] == q {
+				delete(r.queues, client)
+			}
+			r.mu.Unlock()
+		})
+		r.queues[client] = q
+	} else if pos != q.last+1 {
+		// lost a fragment
+		r.drop(client, q)
+		return nil, nil, false
+	}
+	if len(q.data)+len(data) > maxDatagram {
+		r.drop(client, q)
+		return nil, nil, false
+	}
+	q.last = pos
+	q.data = append(q.data, data...)
+	if frag&FRAG_END == 0 {
+		return nil, nil, false
+	}
+	r.drop(client, q)
+	return q.addr, q.data, true
+}
+
+// drop abandons the queue q of client.
+func (r *Reassembler) drop(client string, q *fragQueue) {
+	q.timer.Stop()
+	delete(r.queues, client)
+}
+
+// Forget abandons the pending queue of client, if any.
+func (r *Reassembler) Forget(client string) {
+	r.mu.Lock()
+	if q := r.queues[client]; q != nil {
+		r.drop(client, q)
+	}
+	r.mu.Unlock()
+}
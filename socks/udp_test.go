@@ -0,0 +1,254 @@
+package socks
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func mustAddr(t testing.TB, s string) Addr {
+	a, err := AddrString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestDissectUDP(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		p    []byte
+		frag byte
+		addr string
+		data string
+		err  bool
+	}{
+		{"empty", nil, 0, "", "", true},
+		{"header only", []byte{0, 0, 0}, 0, "", "", true},
+		{"bad reserved", []byte{0, 1, 0, ADDR_IPV4, 1, 2, 3, 4, 0, 53}, 0, "", "", true},
+		{"bad frag", []byte{0, 0, FRAG_END, ADDR_IPV4, 1, 2, 3, 4, 0, 53}, 0, "", "", true},
+		{"bad atyp", []byte{0, 0, 0, 0x02, 1, 2, 3, 4, 0, 53}, 0, "", "", true},
+		{"short ipv4", []byte{0, 0, 0, ADDR_IPV4, 1, 2, 3, 4, 0}, 0, "", "", true},
+		{"short ipv6", append([]byte{0, 0, 0, ADDR_IPV6}, make([]byte, 17)...), 0, "", "", true},
+		{"short fqdn", []byte{0, 0, 0, ADDR_FQDN, 4, 'a', 'b', 'c', 'd', 0}, 0, "", "", true},
+		{"fqdn without length", []byte{0, 0, 0, ADDR_FQDN}, 0, "", "", true},
+		{"empty fqdn", []byte{0, 0, 0, ADDR_FQDN, 0, 0, 53}, 0, "", "", true},
+		{
+			"ipv4",
+			[]byte{0, 0, 0, ADDR_IPV4, 1, 2, 3, 4, 0, 53, 'h', 'i'},
+			0, "1.2.3.4:53", "hi", false,
+		},
+		{
+			"ipv4 without data",
+			[]byte{0, 0, 0, ADDR_IPV4, 1, 2, 3, 4, 0, 53},
+			0, "1.2.3.4:53", "", false,
+		},
+		{
+			"ipv6",
+			append(append([]byte{0, 0, 0, ADDR_IPV6}, mustAddr(t, "[2001:db8::1]:443")[1:]...), 'x'),
+			0, "[2001:db8::1]:443", "x", false,
+		},
+		{
+			"fqdn",
+			[]byte{0, 0, 0, ADDR_FQDN, 4, 'a', '.', 'i', 'o', 0x01, 0xbb, 'h', 'i'},
+			0, "a.io:443", "hi", false,
+		},
+		{
+			"first fragment",
+			[]byte{0, 0, 1, ADDR_IPV4, 1, 2, 3, 4, 0, 53, 'h'},
+			1, "1.2.3.4:53", "h", false,
+		},
+		{
+			"last fragment",
+			[]byte{0, 0, FRAG_END | 2, ADDR_IPV4, 1, 2, 3, 4, 0, 53, 'i'},
+			FRAG_END | 2, "1.2.3.4:53", "i", false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			frag, addr, data, err := DissectUDP(tc.p)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got frag %d addr %s data %q", frag, addr, data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frag != tc.frag || addr.String() != tc.addr || string(data) != tc.data {
+				t.Fatalf(
+					"got frag %d addr %s data %q, expected frag %d addr %s data %q",
+					frag, addr, data, tc.frag, tc.addr, tc.data,
+				)
+			}
+		})
+	}
+}
+
+func TestComposeUDP(t *testing.T) {
+	for _, s := range []string{"1.2.3.4:53", "[2001:db8::1]:443", "example.com:80"} {
+		p, err := ComposeUDP(mustAddr(t, s), []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		frag, addr, data, err := DissectUDP(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frag != 0 || addr.String() != s || string(data) != "data" {
+			t.Fatalf("%s: got frag %d addr %s data %q", s, frag, addr, data)
+		}
+	}
+	for _, a := range []Addr{nil, {ADDR_IPV4, 1, 2}, {0x02, 1, 2, 3, 4, 0, 53}, append(mustAddr(t, "1.2.3.4:53"), 0)} {
+		if _, err := ComposeUDP(a, nil); err == nil {
+			t.Fatalf("expected error composing with address %v", []byte(a))
+		}
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	a, b := mustAddr(t, "1.2.3.4:53"), mustAddr(t, "5.6.7.8:53")
+	type frag struct {
+		client string
+		frag   byte
+		addr   Addr
+		data   string
+	}
+	for _, tc := range []struct {
+		name  string
+		frags []frag
+		addr  Addr
+		data  string
+		ok    bool
+	}{
+		{"unfragmented", []frag{{"c", 0, a, "abc"}}, a, "abc", true},
+		{"single fragment", []frag{{"c", FRAG_END | 1, a, "abc"}}, a, "abc", true},
+		{
+			"in order",
+			[]frag{{"c", 1, a, "a"}, {"c", 2, a, "b"}, {"c", FRAG_END | 3, a, "c"}},
+			a, "abc", true,
+		},
+		{"incomplete", []frag{{"c", 1, a, "a"}, {"c", 2, a, "b"}}, nil, "", false},
+		{"missing start", []frag{{"c", 2, a, "b"}, {"c", FRAG_END | 3, a, "c"}}, nil, "", false},
+		{"lost fragment", []frag{{"c", 1, a, "a"}, {"c", FRAG_END | 3, a, "c"}}, nil, "", false},
+		{
+			"restarted",
+			[]frag{{"c", 1, a, "a"}, {"c", 2, a, "b"}, {"c", 1, a, "x"}, {"c", FRAG_END | 2, a, "y"}},
+			a, "xy", true,
+		},
+		{
+			"lower fragment abandons",
+			[]frag{{"c", 1, a, "a"}, {"c", 2, a, "b"}, {"c", 2, a, "b"}, {"c", FRAG_END | 3, a, "c"}},
+			nil, "", false,
+		},
+		{
+			"destination changed",
+			[]frag{{"c", 1, a, "a"}, {"c", FRAG_END | 2, b, "b"}},
+			nil, "", false,
+		},
+		{
+			"interleaved clients",
+			[]frag{{"c", 1, a, "a"}, {"d", 1, b, "x"}, {"d", 2, b, "y"}, {"c", FRAG_END | 2, a, "b"}},
+			a, "ab", true,
+		},
+		{
+			"unfragmented while reassembling",
+			[]frag{{"c", 1, a, "a"}, {"c", 2, a, "b"}, {"c", 0, b, "x"}, {"c", FRAG_END | 3, a, "c"}},
+			nil, "", false,
+		},
+		{
+			"unfragmented before restart",
+			[]frag{{"c", 1, a, "a"}, {"c", 0, b, "x"}, {"c", 1, a, "y"}, {"c", FRAG_END | 2, a, "z"}},
+			a, "yz", true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewReassembler(time.Minute)
+			var (
+				addr Addr
+				data []byte
+				ok   bool
+			)
+			for _, f := range tc.frags {
+				addr, data, ok = r.Add(f.client, f.frag, f.addr, []byte(f.data))
+			}
+			if ok != tc.ok || !bytes.Equal(addr, tc.addr) || string(data) != tc.data {
+				t.Fatalf("got %s %q %v, expected %s %q %v", addr, data, ok, tc.addr, tc.data, tc.ok)
+			}
+		})
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	a := mustAddr(t, "1.2.3.4:53")
+	r := NewReassembler(10 * time.Millisecond)
+	r.Add("c", 1, a, []byte("a"))
+	time.Sleep(50 * time.Millisecond)
+	if _, _, ok := r.Add("c", FRAG_END|2, a, []byte("b")); ok {
+		t.Fatal("reassembled a datagram after the timeout")
+	}
+	r.mu.Lock()
+	n := len(r.queues)
+	r.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d queues left after the timeout", n)
+	}
+}
+
+func TestReassemblerLimit(t *testing.T) {
+	a := mustAddr(t, "1.2.3.4:53")
+	r := NewReassembler(time.Minute)
+	big := make([]byte, maxDatagram/2+1)
+	r.Add("c", 1, a, big)
+	if _, _, ok := r.Add("c", FRAG_END|2, a, big); ok {
+		t.Fatal("reassembled an oversized datagram")
+	}
+}
+
+func FuzzDissectUDP(f *testing.F) {
+	f.Add([]byte{0, 0, 0, ADDR_IPV4, 1, 2, 3, 4, 0, 53, 'h', 'i'})
+	f.Add([]byte{0, 0, 1, ADDR_FQDN, 4, 'a', '.', 'i', 'o', 0x01, 0xbb})
+	f.Add(append([]byte{0, 0, FRAG_END | 2, ADDR_IPV6}, make([]byte, 18)...))
+	f.Add([]byte{0, 0, 0, ADDR_FQDN, 0xff})
+	f.Fuzz(func(t *testing.T, p []byte) {
+		frag, addr, data, err := DissectUDP(p)
+		if err != nil {
+			return
+		}
+		if addr.String() == "" {
+			t.Fatalf("valid datagram %v with unprintable address", p)
+		}
+		if frag != 0 {
+			return
+		}
+		q, err := ComposeUDP(addr, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, q) {
+			t.Fatalf("round trip of %v gave %v", p, q)
+		}
+	})
+}
+
+func FuzzReassembler(f *testing.F) {
+	f.Add([]byte{1, 2, FRAG_END | 3}, []byte("abc"))
+	f.Add([]byte{1, 1, 0, 2, FRAG_END | 5}, []byte("abcde"))
+	f.Fuzz(func(t *testing.T, frags []byte, data []byte) {
+		r := NewReassembler(time.Minute)
+		a := Addr{ADDR_IPV4, 1, 2, 3, 4, 0, 53}
+		for i, frag := range frags {
+			if frag == FRAG_END {
+				continue
+			}
+			var d []byte
+			if i < len(data) {
+				d = data[i : i+1]
+			}
+			addr, out, ok := r.Add("c", frag, a, d)
+			if ok && (!bytes.Equal(addr, a) || len(out) > len(frags)) {
+				t.Fatalf("reassembled %s %v from fragments %v", addr, out, frags)
+			}
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package circuitcmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/M-ERCURY/core/api/relaylist"
+	"github.com/M-ERCURY/core/cli"
+	"github.com/M-ERCURY/core/cli/fsdir"
+	"github.com/M-ERCURY/poc/circuit"
+	"github.com/M-ERCURY/poc/clientcfg"
+	"github.com/M-ERCURY/poc/filenames"
+)
+
+func Cmd() (r *cli.Subcmd) {
+	r = &cli.Subcmd{
+		FlagSet: flag.NewFlagSet("circuit", flag.ExitOnError),
+		Desc:    "Inspect and control the mercury circuit",
+		Sections: []cli.Section{{
+			Title: "Commands",
+			Entries: []cli.Entry{
+				{Key: "health", Value: "Show relay failures, quarantines and blacklist"},
+				{Key: "rotate", Value: "Switch new connections to fresh circuits"},
+			},
+		}},
+	}
+	r.Writer = tabwriter.NewWriter(r.FlagSet.Output(), 0, 8, 7, ' ', 0)
+	r.SetMinimalUsage("COMMAND")
+	r.Run = func(fm fsdir.T) {
+		if r.FlagSet.NArg() < 1 {
+			r.Usage()
+		}
+		switch cmd := r.FlagSet.Arg(0); cmd {
+		case "health":
+			Health(fm)
+		case "rotate":
+			Rotate(fm)
+		default:
+			log.Fatalf("unknown circuit subcommand: %s", cmd)
+		}
+	}
+	return
+}
+
+// Rotate asks the running mercury daemon to rotate its circuits without
+// reloading configuration and contract information.
+func Rotate(fm fsdir.T) {
+	var pid int
+	if err := fm.Get(&pid, filenames.Pid); err != nil {
+		log.Fatalf("it appears mercury is not running: could not get mercury PID from %s: %s", fm.Path(filenames.Pid), err)
+	}
+	if err := syscall.Kill(pid, syscall.SIGUSR2); err != nil {
+		log.Fatalf("could not rotate circuits of mercury pid %d: %s", pid, err)
+	}
+	log.Printf("rotating circuits of mercury daemon (pid %d)", pid)
+}
+
+// Health prints the relay health state persisted by the mercury daemon.
+func Health(fm fsdir.T) {
+	c := clientcfg.Defaults()
+	if err := fm.Get(&c, filenames.Config); err != nil {
+		log.Fatal(err)
+	}
+	h := circuit.NewHealth()
+	if err := fm.Get(h, filenames.RelayHealth); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatalf("could not read %s: %s", filenames.RelayHealth, err)
+	}
+	// relay list is optional, it's only used to display addresses
+	rl := relaylist.T{}
+	fm.Get(&rl, filenames.Relays)
+	addrs := map[string]string{}
+	for _, r := range rl {
+		addrs[r.Pubkey.String()] = r.Addr.String()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "PUBKEY\tADDRESS\tFAILURES\tSTATE\tLAST ERROR")
+	now := time.Now()
+	es := h.Entries()
+	pks := make([]string, 0, len(es))
+	for pk := range es {
+		pks = append(pks, pk)
+	}
+	sort.Strings(pks)
+	for _, pk := range pks {
+		e := es[pk]
+		state := "ok"
+		if e.Quarantined(now) {
+			state = "quarantined until " + time.Unix(e.Until, 0).Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", pk, addrs[pk], e.Failures, state, e.LastError)
+	}
+	if c.Circuit.Blacklist != nil {
+		for _, k := range *c.Circuit.Blacklist {
+			if r := rl[k]; r != nil {
+				fmt.Fprintf(w, "%s\t%s\t-\tblacklisted\t\n", r.Pubkey, r.Addr)
+				continue
+			}
+			fmt.Fprintf(w, "-\t%s\t-\tblacklisted (unknown relay)\t\n", k)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/M-ERCURY/core/cli/fsdir"
 	"github.com/M-ERCURY/poc/clientcfg"
 	"github.com/M-ERCURY/poc/filenames"
+	"github.com/M-ERCURY/poc/tun/split"
 )
 
 func Cmd(fm0 fsdir.T) *cli.Subcmd {
@@ -101,6 +102,13 @@ func Run(fm fsdir.T, key, val string) {
 				)
 			}
 
+			if key == "split.include" || key == "split.exclude" {
+				// a running mercury_tun reloads these, check them now
+				if _, err = split.New(c.Split.Include, c.Split.Exclude); err != nil {
+					log.Fatalf("could not set %s value to %s: %s", key, val, err)
+				}
+			}
+
 			err = fm.Set(&c, filenames.Config)
 
 			if err != nil {
@@ -116,8 +124,15 @@ func Run(fm fsdir.T, key, val string) {
 
 			syscall.Kill(pid, syscall.SIGUSR1)
 
-			if key == "address.socks" {
-				log.Printf("Note: address.socks changes will take effect on restart.")
+			switch key {
+			case "address.socks", "address.socks_credentials", "address.socks_isolation", "address.h2c_isolation",
+				"address.http", "address.transparent", "address.socket_mode", "address.socket_group",
+				"address.tun6", "address.tun_stack",
+				"dns.intercept", "dns.upstream", "dns.fake_pool",
+				"circuit.pool_size", "circuit.pool_policy",
+				"circuit.dial_attempts", "circuit.dial_timeout",
+				"acl.clients", "acl.allow", "acl.deny":
+				log.Printf("Note: %s changes will take effect on restart.", key)
 			}
 
 			return
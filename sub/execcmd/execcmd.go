@@ -4,6 +4,7 @@ import (
 	"flag"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"syscall"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"github.com/M-ERCURY/core/cli"
 	"github.com/M-ERCURY/core/cli/fsdir"
 	"github.com/M-ERCURY/poc/clientcfg"
+	"github.com/M-ERCURY/poc/clientlib"
 	"github.com/M-ERCURY/poc/filenames"
 )
 
@@ -62,7 +64,8 @@ func Cmd() *cli.Subcmd {
 			log.Fatalf("it appears mercury is not running: %s", err)
 		}
 
-		conn, err := net.DialTimeout("tcp", *c.Address.Socks, time.Second)
+		network, address := clientlib.SplitAddr(*c.Address.Socks)
+		conn, err := net.DialTimeout(network, address, time.Second)
 
 		if err != nil {
 			log.Fatalf("could not connect to mercury at address.socks %s: %s", *c.Address.Socks, err)
@@ -70,12 +73,23 @@ func Cmd() *cli.Subcmd {
 
 		conn.Close()
 
+		// libcurl reaches unix sockets as socks5h://localhost/path
+		var env []string
+		if network == "unix" {
+			env = append(env, "MERCURY_SOCKS_UNIX="+address)
+			address = "localhost" + address
+		}
+		// credentials go in the proxy url, for clients which support them
+		if user, pass, ok := clientlib.SOCKSCredential(c.Address.SocksCredentials); ok {
+			address = url.UserPassword(user, pass).String() + "@" + address
+			env = append(env, "MERCURY_SOCKS_AUTH=1")
+		}
+		env = append(env, "MERCURY_SOCKS="+address)
+
 		err = syscall.Exec(
 			p,
 			fs.Args(),
-			append([]string{
-				"MERCURY_SOCKS=" + *c.Address.Socks,
-			}, os.Environ()...),
+			append(env, os.Environ()...),
 		)
 
 		hint := ""
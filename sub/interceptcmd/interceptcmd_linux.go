@@ -11,6 +11,7 @@ import (
 	"github.com/M-ERCURY/core/cli"
 	"github.com/M-ERCURY/core/cli/fsdir"
 	"github.com/M-ERCURY/poc/clientcfg"
+	"github.com/M-ERCURY/poc/clientlib"
 	"github.com/M-ERCURY/poc/filenames"
 )
 
@@ -40,14 +41,20 @@ func Cmd() *cli.Subcmd {
 				log.Fatal(err)
 			}
 
-			err = syscall.Exec(
-				bin,
-				args,
-				append([]string{
-					"LD_PRELOAD=" + lib,
-					"SOCKS5_PROXY=" + *c.Address.Socks,
-				}, os.Environ()...),
-			)
+			// the preloaded library only connects to tcp proxies
+			if network, _ := clientlib.SplitAddr(*c.Address.Socks); network != "tcp" {
+				log.Fatal("intercept needs a host:port address.socks")
+			}
+
+			env := []string{
+				"LD_PRELOAD=" + lib,
+				"SOCKS5_PROXY=" + *c.Address.Socks,
+			}
+			if user, pass, ok := clientlib.SOCKSCredential(c.Address.SocksCredentials); ok {
+				env = append(env, "SOCKS5_USER="+user, "SOCKS5_PASSWORD="+pass)
+			}
+
+			err = syscall.Exec(bin, args, append(env, os.Environ()...))
 
 			if err != nil {
 				log.Fatal(err)
@@ -0,0 +1,139 @@
+package tracecmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/M-ERCURY/core/api/relayentry"
+	"github.com/M-ERCURY/core/api/servicekey"
+	"github.com/M-ERCURY/core/api/status"
+	"github.com/M-ERCURY/core/cli"
+	"github.com/M-ERCURY/core/cli/fsdir"
+	"github.com/M-ERCURY/core/mrnet/transport"
+	"github.com/M-ERCURY/poc/circuit"
+	"github.com/M-ERCURY/poc/clientcfg"
+	"github.com/M-ERCURY/poc/clientlib"
+	"github.com/M-ERCURY/poc/filenames"
+)
+
+func Cmd() (r *cli.Subcmd) {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	protocol := fs.String("protocol", "tcp", "Target protocol (tcp, tcp4, tcp6, udp...)")
+	r = &cli.Subcmd{
+		FlagSet: fs,
+		Desc: "Dial a target through the current circuit and show per-hop timings\n\n" +
+			"The circuit is read from " + filenames.Circuits + ", which the running daemon\n" +
+			"rewrites whenever its circuits change; it may be stale if the daemon is not\n" +
+			"running or was just switching circuits.",
+		Run: func(fm fsdir.T) {
+			if fs.NArg() != 1 {
+				r.Usage()
+			}
+			Run(fm, *protocol, fs.Arg(0))
+		},
+	}
+	r.SetMinimalUsage("HOST:PORT")
+	return
+}
+
+// Run dials target once through the first circuit of the running mercury
+// daemon and prints a hop-by-hop timing table.
+func Run(fm fsdir.T, protocol, target string) {
+	c := clientcfg.Defaults()
+	if err := fm.Get(&c, filenames.Config); err != nil {
+		log.Fatal(err)
+	}
+	var circs []circuit.T
+	if err := fm.Get(&circs, filenames.Circuits); err != nil || len(circs) == 0 || len(circs[0]) == 0 {
+		if errors.Is(err, os.ErrNotExist) || err == nil {
+			log.Fatal("no circuit found, is mercury running?")
+		}
+		log.Fatalf("could not read %s: %s", filenames.Circuits, err)
+	}
+	circ := circs[0]
+	var sk *servicekey.T
+	if err := fm.Get(&sk, filenames.Servicekey); err != nil {
+		log.Fatalf("could not read servicekey: %s", err)
+	}
+	if sk == nil || sk.Contract == nil || sk.IsExpiredAt(time.Now().Unix()) {
+		log.Fatal("no activated servicekey available, is mercury running?")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOP\tRELAY\tSTAGE\tELAPSED\tERROR")
+	row := func(hop, relay, stage string, info clientlib.TraceInfo) {
+		e := "-"
+		if info.Err != nil {
+			e = info.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", hop, relay, stage, info.Elapsed.Round(time.Microsecond), e)
+	}
+	name := func(hop int) (string, string) {
+		if hop == len(circ) {
+			return "target", target
+		}
+		return fmt.Sprint(hop), circ[hop].Addr.String()
+	}
+	trace := &clientlib.DialTrace{
+		HopDone: func(hop int, r *relayentry.T, info clientlib.TraceInfo) {
+			stage := "hop total"
+			if hop == 0 {
+				stage = "dial"
+			}
+			h, n := name(hop)
+			row(h, n, stage, info)
+		},
+		SharetokenDone: func(hop int, info clientlib.TraceInfo) {
+			h, n := name(hop)
+			row(h, n, "sharetoken", info)
+		},
+		InitWritten: func(hop int, info clientlib.TraceInfo) {
+			h, n := name(hop)
+			row(h, n, "init write", info)
+		},
+		ConnectDone: func(target string, info clientlib.TraceInfo) {
+			row("target", target, "connect", info)
+		},
+	}
+
+	tt := transport.New(transport.Options{Timeout: time.Duration(c.Timeout)})
+	dialer := clientlib.CircuitDialer(
+		func() (*servicekey.T, error) { return sk, nil },
+		func(string) (circuit.T, error) { return circ, nil },
+		clientlib.DialSMContext(tt),
+		clientlib.DialOptions{},
+	)
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.Timeout))
+		defer cancel()
+	}
+	// keep the table readable
+	log.SetOutput(ioutil.Discard)
+	t0 := time.Now()
+	conn, err := dialer(clientlib.WithDialTrace(ctx, trace), protocol, target)
+	row("", "", "total", clientlib.TraceInfo{Elapsed: time.Since(t0), Err: err})
+	w.Flush()
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		os.Exit(1)
+	}
+	defer conn.Close()
+	// relays only report connect failures asynchronously
+	wait := 2 * time.Second
+	conn.SetDeadline(time.Now().Add(wait))
+	var se *status.T
+	if _, err := conn.Read(make([]byte, 1)); errors.As(err, &se) {
+		fmt.Printf("circuit reported connect failure: %s\n", se)
+		os.Exit(1)
+	}
+	fmt.Printf("no connect failure reported by circuit within %s\n", wait)
+}
@@ -0,0 +1,8 @@
+package transparentcmd
+
+import (
+	"github.com/M-ERCURY/core/cli"
+)
+
+// the transparent proxy is unsupported on Darwin
+func Cmd() *cli.Subcmd { return nil }
@@ -0,0 +1,150 @@
+package transparentcmd
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/M-ERCURY/core/cli"
+	"github.com/M-ERCURY/core/cli/fsdir"
+	"github.com/M-ERCURY/poc/clientcfg"
+	"github.com/M-ERCURY/poc/filenames"
+)
+
+const (
+	// firewall mark and routing table of TPROXYed traffic
+	mark  = "0x1"
+	table = "100"
+)
+
+func Cmd() (r *cli.Subcmd) {
+	fs := flag.NewFlagSet("transparent", flag.ExitOnError)
+	tproxy := fs.Bool("tproxy", false, "Use TPROXY for tcp and udp instead of REDIRECT for tcp only")
+	uid := fs.Int("uid", -1, "User mercury runs as, exempt from redirection (default: owner of the mercury directory)")
+	r = &cli.Subcmd{
+		FlagSet: fs,
+		Desc:    "Manage firewall rules for the transparent proxy",
+		Sections: []cli.Section{{
+			Title: "Commands",
+			Entries: []cli.Entry{
+				{"print", "Print the firewall rules for address.transparent"},
+				{"install", "Install the firewall rules (requires root)"},
+				{"remove", "Remove the installed firewall rules (requires root)"},
+			},
+		}},
+	}
+	r.Writer = tabwriter.NewWriter(fs.Output(), 0, 8, 7, ' ', 0)
+	r.SetMinimalUsage("[OPTIONS] COMMAND")
+	r.Run = func(fm fsdir.T) {
+		if fs.NArg() != 1 {
+			r.Usage()
+		}
+		c := clientcfg.Defaults()
+		if err := fm.Get(&c, filenames.Config); err != nil {
+			log.Fatal(err)
+		}
+		if c.Address.Transparent == nil {
+			log.Fatal("`address.transparent` in config is null, please define one for this command to work")
+		}
+		host, port, err := net.SplitHostPort(*c.Address.Transparent)
+		if err != nil {
+			log.Fatalf("invalid address.transparent %s: %s", *c.Address.Transparent, err)
+		}
+		if *uid < 0 {
+			fi, err := os.Stat(fm.Path())
+			if err != nil {
+				log.Fatal(err)
+			}
+			*uid = int(fi.Sys().(*syscall.Stat_t).Uid)
+		}
+		add := rules(host, port, *uid, *tproxy, true)
+		switch fs.Arg(0) {
+		case "print":
+			for _, args := range add {
+				fmt.Println(strings.Join(args, " "))
+			}
+		case "install":
+			for _, args := range add {
+				if err := run(args); err != nil {
+					log.Fatalf("could not install firewall rule `%s`: %s", strings.Join(args, " "), err)
+				}
+			}
+			log.Printf("transparent proxy rules for %s installed", *c.Address.Transparent)
+		case "remove":
+			del := rules(host, port, *uid, *tproxy, false)
+			for i := len(del) - 1; i >= 0; i-- {
+				if err := run(del[i]); err != nil {
+					log.Printf("could not remove firewall rule `%s`: %s", strings.Join(del[i], " "), err)
+				}
+			}
+		default:
+			log.Fatalf("unknown transparent subcommand: %s", fs.Arg(0))
+		}
+	}
+	return
+}
+
+// rules returns the commands adding, or deleting if add is false, the
+// firewall rules redirecting the local traffic of all users but uid to the
+// transparent proxy listening on host:port. With tproxy, tcp and udp are
+// TPROXYed; otherwise only tcp is REDIRECTed.
+func rules(host, port string, uid int, tproxy, add bool) (r [][]string) {
+	op, ipop := "-A", "add"
+	if !add {
+		op, ipop = "-D", "del"
+	}
+	ip := net.ParseIP(host)
+	type family struct {
+		ipt, ipflag, loopback, any string
+	}
+	var families []family
+	if ip == nil || ip.IsUnspecified() || ip.To4() != nil {
+		families = append(families, family{"iptables", "-4", "127.0.0.0/8", "0.0.0.0/0"})
+	}
+	if ip == nil || ip.IsUnspecified() || ip.To4() == nil {
+		families = append(families, family{"ip6tables", "-6", "::1/128", "::/0"})
+	}
+	owner := []string{"-m", "owner", "!", "--uid-owner", strconv.Itoa(uid)}
+	for _, f := range families {
+		if !tproxy {
+			r = append(r, append(append(
+				[]string{f.ipt, "-t", "nat", op, "OUTPUT", "-p", "tcp", "!", "-d", f.loopback},
+				owner...), "-j", "REDIRECT", "--to-ports", port,
+			))
+			continue
+		}
+		// locally generated packets are marked and routed back in through
+		// lo, where they can be TPROXYed
+		r = append(r,
+			[]string{"ip", f.ipflag, "rule", ipop, "fwmark", mark, "lookup", table},
+			[]string{"ip", f.ipflag, "route", ipop, "local", f.any, "dev", "lo", "table", table},
+		)
+		for _, proto := range []string{"tcp", "udp"} {
+			r = append(r, append(append(
+				[]string{f.ipt, "-t", "mangle", op, "OUTPUT", "-p", proto, "!", "-d", f.loopback},
+				owner...), "-j", "MARK", "--set-mark", mark,
+			))
+			tp := []string{f.ipt, "-t", "mangle", op, "PREROUTING", "-i", "lo", "-p", proto,
+				"-m", "mark", "--mark", mark, "-j", "TPROXY", "--on-port", port, "--tproxy-mark", mark}
+			if ip != nil && !ip.IsUnspecified() {
+				tp = append(tp, "--on-ip", host)
+			}
+			r = append(r, tp)
+		}
+	}
+	return
+}
+
+// run runs a firewall command.
+func run(args []string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
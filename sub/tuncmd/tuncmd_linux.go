@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -18,7 +19,10 @@ import (
 	"github.com/M-ERCURY/core/cli/commonsub/stopcmd"
 	"github.com/M-ERCURY/core/cli/fsdir"
 	"github.com/M-ERCURY/poc/clientcfg"
+	"github.com/M-ERCURY/poc/clientlib"
 	"github.com/M-ERCURY/poc/filenames"
+	"github.com/M-ERCURY/poc/tun/fakeip"
+	"github.com/M-ERCURY/poc/tun/split"
 )
 
 const bin = "mercury_tun"
@@ -81,7 +85,8 @@ func Cmd() (r *cli.Subcmd) {
 			if c.Address.Tun == nil {
 				log.Fatal("`address.tun` in config is null, please define one for this command to work")
 			}
-			conn, err := net.DialTimeout("tcp", *c.Address.H2C, time.Second)
+			network, address := clientlib.SplitAddr(*c.Address.H2C)
+			conn, err := net.DialTimeout(network, address, time.Second)
 			if err != nil {
 				log.Fatalf("could not connect to mercury at address.h2c %s: %s", *c.Address.H2C, err)
 			}
@@ -91,7 +96,11 @@ func Cmd() (r *cli.Subcmd) {
 				"MERCURY_HOME="+fm.Path(),
 				"MERCURY_ADDR_H2C="+*c.Address.H2C,
 				"MERCURY_ADDR_TUN="+*c.Address.Tun,
+				"MERCURY_ADDR_TUN6="+tun6(c),
+				"MERCURY_TUN_STACK="+stack(c),
 			)
+			env = append(env, dnsenv(c)...)
+			checksplit(c)
 			if r.FlagSet.Arg(1) != "--fg" {
 				err = fm.Get(&pid, bin+".pid")
 				if err == nil {
@@ -211,7 +220,8 @@ func Start(fm fsdir.T, c clientcfg.C) {
 		log.Fatal("`address.tun` in config is null, please define one for this command to work")
 	}
 
-	conn, err := net.DialTimeout("tcp", *c.Address.H2C, time.Second)
+	network, address := clientlib.SplitAddr(*c.Address.H2C)
+	conn, err := net.DialTimeout(network, address, time.Second)
 	if err != nil {
 		log.Fatalf("could not connect to mercury at address.h2c %s: %s", *c.Address.H2C, err)
 	}
@@ -222,7 +232,11 @@ func Start(fm fsdir.T, c clientcfg.C) {
 		"MERCURY_HOME="+fm.Path(),
 		"MERCURY_ADDR_H2C="+*c.Address.H2C,
 		"MERCURY_ADDR_TUN="+*c.Address.Tun,
+		"MERCURY_ADDR_TUN6="+tun6(c),
+		"MERCURY_TUN_STACK="+stack(c),
 	)
+	env = append(env, dnsenv(c)...)
+	checksplit(c)
 
 	err = fm.Get(&pid, bin+".pid")
 	if err == nil {
@@ -274,6 +288,64 @@ func Start(fm fsdir.T, c clientcfg.C) {
 	}
 }
 
+// stack returns the configured flow termination mode of mercury_tun.
+func stack(c clientcfg.C) string {
+	if c.Address.TunStack == nil {
+		return "netstack"
+	}
+	switch *c.Address.TunStack {
+	case "netstack", "nat":
+		return *c.Address.TunStack
+	}
+	log.Fatalf("invalid address.tun_stack %s, expected netstack or nat", *c.Address.TunStack)
+	return ""
+}
+
+// tun6 returns the configured IPv6 address of the tun device, empty if none.
+func tun6(c clientcfg.C) string {
+	if c.Address.Tun6 == nil {
+		return ""
+	}
+	if ip := net.ParseIP(*c.Address.Tun6); ip == nil || ip.To4() != nil {
+		log.Fatalf("invalid address.tun6 %s, expected an IPv6 address", *c.Address.Tun6)
+	}
+	return *c.Address.Tun6
+}
+
+// dnsenv returns the environment configuring the DNS interception of
+// mercury_tun.
+func dnsenv(c clientcfg.C) []string {
+	if !c.DNS.Intercept {
+		return []string{"MERCURY_TUN_DNS="}
+	}
+	var upstream, pool string
+	if c.DNS.Upstream != nil {
+		if _, _, err := net.SplitHostPort(*c.DNS.Upstream); err != nil {
+			log.Fatalf("invalid dns.upstream %s: %s", *c.DNS.Upstream, err)
+		}
+		upstream = *c.DNS.Upstream
+	}
+	if c.DNS.FakePool != nil && len(*c.DNS.FakePool) > 0 {
+		if _, err := fakeip.New(*c.DNS.FakePool); err != nil {
+			log.Fatalf("invalid dns.fake_pool: %s", err)
+		}
+		pool = strings.Join(*c.DNS.FakePool, ",")
+	}
+	return []string{
+		"MERCURY_TUN_DNS=1",
+		"MERCURY_TUN_DNS_UPSTREAM=" + upstream,
+		"MERCURY_TUN_FAKE_POOL=" + pool,
+	}
+}
+
+// checksplit checks the split tunneling rules mercury_tun reads from the
+// config file.
+func checksplit(c clientcfg.C) {
+	if _, err := split.New(c.Split.Include, c.Split.Exclude); err != nil {
+		log.Fatalf("invalid split rules: %s", err)
+	}
+}
+
 func Stop(fm fsdir.T) {
 	stopcmd.Cmd(bin).Run(fm)
 }
@@ -0,0 +1,348 @@
+// Package conntrack tracks the flows mercury_tun NATs into its kernel sockets,
+// keyed by their 5-tuple.
+package conntrack
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Proto is the transport protocol of a flow.
+type Proto uint8
+
+const (
+	TCP Proto = iota
+	UDP
+	nprotos
+)
+
+func (p Proto) String() string {
+	if p == TCP {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// Key is the 5-tuple of a flow, as sent by the client.
+type Key struct {
+	Proto    Proto
+	Src, Dst netip.AddrPort
+}
+
+func (k Key) String() string { return fmt.Sprintf("%s %s -> %s", k.Proto, k.Src, k.Dst) }
+
+// State is the state of a flow.
+type State uint8
+
+const (
+	// Opening flows have only been seen from the client.
+	Opening State = iota
+	// Established flows have been answered.
+	Established
+	// Closing tcp flows have seen a FIN.
+	Closing
+	// Closed tcp flows have seen a RST or FINs both ways.
+	Closed
+)
+
+func (s State) String() string {
+	return [...]string{"opening", "established", "closing", "closed"}[s]
+}
+
+// Flags are the tcp flags of a tracked packet.
+type Flags uint8
+
+const (
+	SYN Flags = 1 << iota
+	ACK
+	FIN
+	RST
+)
+
+// Timeout returns how long a flow of proto in state s may stay idle; tcp
+// timeouts follow RFC 5382, udp ones RFC 4787.
+func Timeout(proto Proto, s State) time.Duration {
+	switch {
+	case proto == UDP:
+		return 2 * time.Minute
+	case s == Established:
+		return 2*time.Hour + 4*time.Minute
+	case s == Closed:
+		return 10 * time.Second
+	}
+	return 4 * time.Minute
+}
+
+const (
+	// DefaultMax is the default maximum number of tracked flows.
+	DefaultMax = 16384
+	// NAT ports are allocated from this range
+	minPort = 1024
+	maxPort = 65535
+)
+
+// Entry is a tracked flow.
+type Entry struct {
+	Key
+	// Port is the source port the flow is NATed to.
+	Port uint16
+
+	ready chan struct{}
+	elem  *list.Element
+
+	mu      sync.Mutex // guards the fields below
+	conn    net.Conn
+	state   State
+	fins    uint8 // client and reply FINs seen
+	seen    time.Time
+	removed bool
+}
+
+// SetConn sets the connection the flow is relayed through, nil if it could
+// not be dialed, and wakes up Wait. It must be called once. If the entry has
+// already been removed, c is closed.
+func (e *Entry) SetConn(c net.Conn) {
+	e.mu.Lock()
+	e.conn = c
+	close(e.ready)
+	removed := e.removed
+	e.mu.Unlock()
+	if removed && c != nil {
+		c.Close()
+	}
+}
+
+// Conn returns the connection of the flow and whether it was set already.
+func (e *Entry) Conn() (net.Conn, bool) {
+	select {
+	case <-e.ready:
+	default:
+		return nil, false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.conn, true
+}
+
+// Wait waits for the connection of the flow to be set and returns it.
+func (e *Entry) Wait() net.Conn {
+	<-e.ready
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.conn
+}
+
+// State returns the state of the flow.
+func (e *Entry) State() State {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.state
+}
+
+// T is a concurrency-safe connection tracking table. When full, adding a flow
+// evicts the least recently seen one.
+type T struct {
+	max int
+
+	mu    sync.Mutex // guards the fields below
+	flows map[Key]*Entry
+	ports [nprotos]map[uint16]*Entry
+	next  [nprotos]uint16
+	lru   *list.List // front is most recently seen
+}
+
+// New returns a table tracking at most max flows, DefaultMax if max <= 0.
+func New(max int) *T {
+	if max <= 0 || max > maxPort-minPort {
+		max = DefaultMax
+	}
+	t := &T{
+		max:   max,
+		flows: map[Key]*Entry{},
+		lru:   list.New(),
+	}
+	for p := range t.ports {
+		t.ports[p] = map[uint16]*Entry{}
+		t.next[p] = minPort
+	}
+	return t
+}
+
+// Get returns the flow with key k, nil if it is not tracked.
+func (t *T) Get(k Key) *Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.flows[k]
+}
+
+// Lookup returns the flow of proto NATed to port, nil if there is none.
+func (t *T) Lookup(proto Proto, port uint16) *Entry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ports[proto][port]
+}
+
+// Add starts tracking the flow with key k, allocating it a NAT port, and
+// returns it, or the existing flow if it is already tracked.
+func (t *T) Add(k Key) *Entry {
+	t.mu.Lock()
+	if e, ok := t.flows[k]; ok {
+		t.mu.Unlock()
+		return e
+	}
+	var evicted *Entry
+	if len(t.flows) >= t.max {
+		evicted = t.lru.Back().Value.(*Entry)
+		t.remove(evicted)
+	}
+	ports := t.ports[k.Proto]
+	port := t.next[k.Proto]
+	for ports[port] != nil {
+		if port++; port < minPort {
+			port = minPort
+		}
+	}
+	t.next[k.Proto] = port + 1
+	if t.next[k.Proto] < minPort {
+		t.next[k.Proto] = minPort
+	}
+	e := &Entry{Key: k, Port: port, ready: make(chan struct{}), seen: time.Now()}
+	e.elem = t.lru.PushFront(e)
+	t.flows[k] = e
+	ports[port] = e
+	t.mu.Unlock()
+	if evicted != nil {
+		evicted.close()
+	}
+	return e
+}
+
+// Track records a packet of flow e, from the client or a reply, with tcp
+// flags f, and updates its state.
+func (t *T) Track(e *Entry, reply bool, f Flags) {
+	t.mu.Lock()
+	if !e.isRemoved() {
+		t.lru.MoveToFront(e.elem)
+	}
+	t.mu.Unlock()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seen = time.Now()
+	if e.Proto == UDP {
+		if reply {
+			e.state = Established
+		}
+		return
+	}
+	switch {
+	case f&RST != 0:
+		e.state = Closed
+	case f&FIN != 0:
+		if reply {
+			e.fins |= 2
+		} else {
+			e.fins |= 1
+		}
+		if e.state = Closing; e.fins == 3 {
+			e.state = Closed
+		}
+	case reply && f&SYN != 0 && f&ACK != 0 && e.state == Opening:
+		e.state = Established
+	}
+}
+
+// Del stops tracking flow e and closes its connection.
+func (t *T) Del(e *Entry) {
+	t.mu.Lock()
+	removed := e.isRemoved()
+	if !removed {
+		t.remove(e)
+	}
+	t.mu.Unlock()
+	if !removed {
+		e.close()
+	}
+}
+
+// Expire stops tracking the flows idle for longer than their timeout at now,
+// closing their connections, and returns how many were.
+func (t *T) Expire(now time.Time) int {
+	var expired []*Entry
+	t.mu.Lock()
+	for _, e := range t.flows {
+		e.mu.Lock()
+		if now.Sub(e.seen) > Timeout(e.Proto, e.state) {
+			expired = append(expired, e)
+		}
+		e.mu.Unlock()
+	}
+	for _, e := range expired {
+		t.remove(e)
+	}
+	t.mu.Unlock()
+	for _, e := range expired {
+		e.close()
+	}
+	return len(expired)
+}
+
+// Len returns the number of tracked flows.
+func (t *T) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.flows)
+}
+
+// Dump writes the tracked flows to w, one per line, ordered by key.
+func (t *T) Dump(w io.Writer) error {
+	t.mu.Lock()
+	es := make([]*Entry, 0, len(t.flows))
+	for _, e := range t.flows {
+		es = append(es, e)
+	}
+	t.mu.Unlock()
+	sort.Slice(es, func(i, j int) bool { return es[i].Key.String() < es[j].Key.String() })
+	if _, err := fmt.Fprintf(w, "%d/%d flows\n", len(es), t.max); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range es {
+		e.mu.Lock()
+		state, idle := e.state, now.Sub(e.seen).Truncate(time.Second)
+		e.mu.Unlock()
+		if _, err := fmt.Fprintf(w, "%s nat=%d %s idle=%s\n", e.Key, e.Port, state, idle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes e from the table; t.mu must be held.
+func (t *T) remove(e *Entry) {
+	delete(t.flows, e.Key)
+	delete(t.ports[e.Proto], e.Port)
+	t.lru.Remove(e.elem)
+	e.mu.Lock()
+	e.removed = true
+	e.mu.Unlock()
+}
+
+// isRemoved reports whether e was removed from its table; t.mu must be held.
+func (e *Entry) isRemoved() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.removed
+}
+
+// close closes the connection of a removed flow, if it has been set.
+func (e *Entry) close() {
+	if c, ok := e.Conn(); ok && c != nil {
+		c.Close()
+	}
+}
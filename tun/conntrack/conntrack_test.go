@@ -0,0 +1,118 @@
+package conntrack
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func key(proto Proto, src, dst string) Key {
+	return Key{proto, netip.MustParseAddrPort(src), netip.MustParseAddrPort(dst)}
+}
+
+func TestTrack(t *testing.T) {
+	ct := New(0)
+	k := key(TCP, "10.0.0.1:40000", "1.2.3.4:443")
+	e := ct.Add(k)
+	if e.Port < minPort {
+		t.Fatalf("nat port %d out of range", e.Port)
+	}
+	if ct.Add(k) != e || ct.Get(k) != e || ct.Lookup(TCP, e.Port) != e {
+		t.Fatal("flow not found by key or nat port")
+	}
+	if ct.Lookup(UDP, e.Port) != nil {
+		t.Fatal("tcp flow found as udp")
+	}
+	if e2 := ct.Add(key(TCP, "10.0.0.1:40001", "1.2.3.4:443")); e2.Port == e.Port {
+		t.Fatal("nat port allocated twice")
+	}
+	for _, tc := range []struct {
+		reply bool
+		f     Flags
+		state State
+	}{
+		{false, SYN, Opening},
+		{true, SYN | ACK, Established},
+		{false, ACK, Established},
+		{false, FIN | ACK, Closing},
+		{true, ACK, Closing},
+		{true, FIN | ACK, Closed},
+	} {
+		if ct.Track(e, tc.reply, tc.f); e.State() != tc.state {
+			t.Fatalf("reply=%v flags=%b: got state %s, expected %s", tc.reply, tc.f, e.State(), tc.state)
+		}
+	}
+	e = ct.Add(key(UDP, "10.0.0.1:5353", "8.8.8.8:53"))
+	if ct.Track(e, false, 0); e.State() != Opening {
+		t.Fatalf("got udp state %s, expected opening", e.State())
+	}
+	if ct.Track(e, true, 0); e.State() != Established {
+		t.Fatalf("got udp state %s, expected established", e.State())
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ct := New(0)
+	closed := ct.Add(key(TCP, "10.0.0.1:40000", "1.2.3.4:443"))
+	ct.Track(closed, false, RST)
+	est := ct.Add(key(TCP, "10.0.0.1:40001", "1.2.3.4:443"))
+	ct.Track(est, true, SYN|ACK)
+	udp := ct.Add(key(UDP, "10.0.0.1:5353", "8.8.8.8:53"))
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	udp.SetConn(c1)
+	now := time.Now()
+	if n := ct.Expire(now.Add(time.Minute)); n != 1 || ct.Get(closed.Key) != nil {
+		t.Fatalf("expired %d flows, expected the closed one", n)
+	}
+	if n := ct.Expire(now.Add(time.Hour)); n != 1 || ct.Get(udp.Key) != nil {
+		t.Fatalf("expired %d flows, expected the udp one", n)
+	}
+	if _, err := c2.Write([]byte{0}); err == nil {
+		t.Fatal("expired flow connection not closed")
+	}
+	if n := ct.Expire(now.Add(3 * time.Hour)); n != 1 || ct.Len() != 0 {
+		t.Fatalf("expired %d flows, expected the established one", n)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	ct := New(2)
+	a := ct.Add(key(TCP, "10.0.0.1:1", "1.2.3.4:443"))
+	b := ct.Add(key(TCP, "10.0.0.1:2", "1.2.3.4:443"))
+	ct.Track(a, false, ACK)
+	c := ct.Add(key(TCP, "10.0.0.1:3", "1.2.3.4:443"))
+	if ct.Len() != 2 || ct.Get(b.Key) != nil || ct.Get(a.Key) != a || ct.Get(c.Key) != c {
+		t.Fatal("least recently seen flow not evicted")
+	}
+	if ct.Lookup(TCP, b.Port) != nil {
+		t.Fatal("evicted flow nat port still allocated")
+	}
+	// a conn set after removal is closed
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	b.SetConn(c1)
+	if _, err := c2.Write([]byte{0}); err == nil {
+		t.Fatal("evicted flow connection not closed")
+	}
+}
+
+func TestDump(t *testing.T) {
+	ct := New(10)
+	ct.Add(key(UDP, "10.0.0.1:5353", "8.8.8.8:53"))
+	e := ct.Add(key(TCP, "[fd00::1]:40000", "[2001:db8::1]:443"))
+	ct.Track(e, true, SYN|ACK)
+	var b bytes.Buffer
+	if err := ct.Dump(&b); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 || lines[0] != "2/10 flows" ||
+		!strings.HasPrefix(lines[1], "tcp [fd00::1]:40000 -> [2001:db8::1]:443 nat=1024 established") ||
+		!strings.HasPrefix(lines[2], "udp 10.0.0.1:5353 -> 8.8.8.8:53 nat=1024 opening") {
+		t.Fatalf("unexpected dump:\n%s", b.String())
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/M-ERCURY/poc/tun/fakeip"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// upstream answers are waited on for this long
+	dnsTimeout = 5 * time.Second
+	// fake addresses outlive their TTL until the pool wraps around
+	fakeTTL = 60
+	// maximum udp answer size for clients without EDNS
+	dnsUDPSize = 512
+	// HTTPS records carry address hints which would bypass fake addresses
+	typeHTTPS = dnsmessage.Type(65)
+)
+
+// dnsr intercepts the DNS queries of tun clients, nil if they are not.
+var dnsr *resolver
+
+// resolver answers the DNS queries of tun clients, either relaying them over
+// TCP through the circuit so that names are resolved by the exit's side, or
+// with fake addresses standing in for the queried names.
+type resolver struct {
+	// upstream overrides the resolver queries were sent to, if not empty
+	upstream string
+	// fake address pool, if any
+	pool *fakeip.Pool
+	dial func(protocol, target string) (net.Conn, error)
+
+	mu    sync.Mutex // guards conns
+	conns map[string]*dnsconn
+}
+
+// newResolver returns a resolver relaying queries through mercury's h2c
+// listener at h2caddr.
+func newResolver(h2caddr, upstream string, pool *fakeip.Pool) *resolver {
+	tt, h2curl := h2ctransport(h2caddr)
+	return &resolver{
+		upstream: upstream,
+		pool:     pool,
+		dial: func(protocol, target string) (net.Conn, error) {
+			return dial(tt, h2curl, protocol, target)
+		},
+		conns: map[string]*dnsconn{},
+	}
+}
+
+// serve returns a connection on which the DNS queries of a udp or tcp flow to
+// server are answered.
+func (r *resolver) serve(protocol, server string) net.Conn {
+	c, s := net.Pipe()
+	go func() {
+		defer s.Close()
+		if protocol == "udp" {
+			// pipe writes aren't coalesced, one is one datagram
+			buf := make([]byte, 65535)
+			for {
+				n, err := s.Read(buf)
+				if err != nil {
+					return
+				}
+				q := append([]byte(nil), buf[:n]...)
+				go func() {
+					if m := r.answer(q, server, true); m != nil {
+						s.Write(m)
+					}
+				}()
+			}
+		}
+		br := bufio.NewReader(s)
+		for {
+			q, err := readmsg(br)
+			if err != nil {
+				return
+			}
+			go func() {
+				if m := r.answer(q, server, false); m != nil {
+					s.Write(frame(m))
+				}
+			}()
+		}
+	}()
+	return c
+}
+
+// answer returns the answer to query q sent to server over udp or tcp, nil if
+// q is to be dropped.
+func (r *resolver) answer(q []byte, server string, udp bool) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil || h.Response {
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	if r.pool != nil && question.Class == dnsmessage.ClassINET {
+		name := strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+		switch {
+		case !splitr.Load().TunnelName(name):
+			// flows to the name go direct, they need its real addresses
+		case question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeAAAA:
+			// without a pool of the family, the answer is empty
+			a, _ := r.pool.Addr(name, question.Type == dnsmessage.TypeAAAA)
+			return reply(h, question, dnsmessage.RCodeSuccess, false, a)
+		case question.Type == typeHTTPS:
+			return reply(h, question, dnsmessage.RCodeSuccess, false, netip.Addr{})
+		}
+	}
+	if r.upstream != "" {
+		server = r.upstream
+	}
+	m, err := r.exchange(server, q)
+	if err != nil {
+		log.Printf("error relaying dns query for %s to %s: %s", question.Name, server, err)
+		return reply(h, question, dnsmessage.RCodeServerFailure, false, netip.Addr{})
+	}
+	if udp && len(m) > udpsize(&p) {
+		// the client retries over tcp
+		return reply(h, question, dnsmessage.RCodeSuccess, true, netip.Addr{})
+	}
+	return m
+}
+
+// lookup resolves name to its real addresses with the upstream resolver.
+func (r *resolver) lookup(name string) (addrs []netip.Addr, err error) {
+	if r.upstream == "" {
+		return nil, fmt.Errorf("no upstream resolver to look %s up with", name)
+	}
+	n, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{RecursionDesired: true})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: n, Type: t, Class: dnsmessage.ClassINET})
+		q, err := b.Finish()
+		if err != nil {
+			return nil, err
+		}
+		a, err := r.exchange(r.upstream, q)
+		if err != nil {
+			return nil, err
+		}
+		var m dnsmessage.Message
+		if err = m.Unpack(a); err != nil {
+			return nil, err
+		}
+		for _, rr := range m.Answers {
+			switch b := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, netip.AddrFrom4(b.A))
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, netip.AddrFrom16(b.AAAA))
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", name)
+	}
+	return
+}
+
+// udpsize returns the maximum udp answer size of the query parsed by p up to
+// its question.
+func udpsize(p *dnsmessage.Parser) int {
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return dnsUDPSize
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return dnsUDPSize
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			// the OPT record's class is the requestor's udp payload size
+			return max(int(h.Class), dnsUDPSize)
+		}
+		if p.SkipAdditional() != nil {
+			return dnsUDPSize
+		}
+	}
+}
+
+// reply returns the answer to query h with question q, with the address a if
+// it is valid.
+func reply(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode, truncated bool, a netip.Addr) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		Truncated:          truncated,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	err := b.StartQuestions()
+	if err == nil {
+		err = b.Question(q)
+	}
+	if err == nil && a.IsValid() {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: fakeTTL}
+		if err = b.StartAnswers(); err == nil && a.Is4() {
+			err = b.AResource(rh, dnsmessage.AResource{A: a.As4()})
+		} else if err == nil {
+			err = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: a.As16()})
+		}
+	}
+	m, err2 := b.Finish()
+	if err != nil || err2 != nil {
+		log.Printf("could not build dns answer for %s: %v %v", q.Name, err, err2)
+		return nil
+	}
+	return m
+}
+
+// exchange relays query q to server and returns its answer. Queries to a
+// server being dialed wait for the dial.
+func (r *resolver) exchange(server string, q []byte) ([]byte, error) {
+	r.mu.Lock()
+	dc := r.conns[server]
+	if dc != nil {
+		r.mu.Unlock()
+		<-dc.ready
+		return dc.exchange(q)
+	}
+	dc = &dnsconn{ready: make(chan struct{}), pending: map[uint16]chan []byte{}}
+	r.conns[server] = dc
+	r.mu.Unlock()
+	// dial without holding mu, other servers are not held up
+	c, err := r.dial("tcp", server)
+	if err != nil {
+		r.remove(server, dc)
+		dc.mu.Lock()
+		dc.err = err
+		dc.mu.Unlock()
+		close(dc.ready)
+		return nil, err
+	}
+	dc.Conn = c
+	close(dc.ready)
+	go func() {
+		err := dc.read()
+		r.remove(server, dc)
+		dc.fail(err)
+	}()
+	return dc.exchange(q)
+}
+
+// remove forgets the connection dc to server, unless it was replaced.
+func (r *resolver) remove(server string, dc *dnsconn) {
+	r.mu.Lock()
+	if r.conns[server] == dc {
+		delete(r.conns, server)
+	}
+	r.mu.Unlock()
+}
+
+// dnsconn is a DNS over TCP connection to an upstream resolver, on which
+// queries are pipelined.
+type dnsconn struct {
+	net.Conn
+	// closed once Conn is dialed, or err is set if that failed
+	ready chan struct{}
+
+	mu      sync.Mutex // guards the fields below and writes
+	next    uint16
+	pending map[uint16]chan []byte
+	err     error
+}
+
+// exchange sends query q and returns its answer.
+func (dc *dnsconn) exchange(q []byte) ([]byte, error) {
+	res := make(chan []byte, 1)
+	dc.mu.Lock()
+	if dc.err != nil {
+		dc.mu.Unlock()
+		return nil, dc.err
+	}
+	for dc.pending[dc.next] != nil {
+		dc.next++
+	}
+	id := dc.next
+	dc.next++
+	dc.pending[id] = res
+	// queries are sent with their own id, as they come from different clients
+	f := frame(q)
+	binary.BigEndian.PutUint16(f[2:], id)
+	if _, err := dc.Write(f); err != nil {
+		// fails the pending queries
+		dc.Close()
+	}
+	dc.mu.Unlock()
+	select {
+	case m, ok := <-res:
+		if !ok {
+			dc.mu.Lock()
+			defer dc.mu.Unlock()
+			return nil, dc.err
+		}
+		copy(m, q[:2])
+		return m, nil
+	case <-time.After(dnsTimeout):
+		dc.mu.Lock()
+		delete(dc.pending, id)
+		dc.mu.Unlock()
+		return nil, errors.New("timed out waiting for answer")
+	}
+}
+
+// read reads answers and hands them to their pending queries until the
+// connection fails.
+func (dc *dnsconn) read() error {
+	br := bufio.NewReader(dc.Conn)
+	for {
+		m, err := readmsg(br)
+		if err != nil {
+			return err
+		}
+		id := binary.BigEndian.Uint16(m)
+		dc.mu.Lock()
+		res := dc.pending[id]
+		delete(dc.pending, id)
+		dc.mu.Unlock()
+		if res != nil {
+			res <- m
+		}
+	}
+}
+
+// fail closes the connection and fails its pending queries with err.
+func (dc *dnsconn) fail(err error) {
+	dc.Close()
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if err == nil || errors.Is(err, io.EOF) {
+		err = errors.New("upstream connection closed")
+	}
+	dc.err = err
+	for id, res := range dc.pending {
+		close(res)
+		delete(dc.pending, id)
+	}
+}
+
+// readmsg reads a length-prefixed DNS over TCP message.
+func readmsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	m := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, m); err != nil {
+		return nil, err
+	}
+	if len(m) < 12 {
+		return nil, errors.New("short dns message")
+	}
+	return m, nil
+}
+
+// frame returns m prefixed with its length for DNS over TCP.
+func frame(m []byte) []byte {
+	f := make([]byte, 2+len(m))
+	binary.BigEndian.PutUint16(f, uint16(len(m)))
+	copy(f[2:], m)
+	return f
+}
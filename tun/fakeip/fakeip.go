@@ -0,0 +1,156 @@
+// Package fakeip hands out addresses from reserved pools standing in for
+// hostnames, so that flows to them can be dialed by name.
+package fakeip
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// MaxSize is the maximum number of names a pool of one address family maps at
+// once; beyond it, the least recently used addresses are reused.
+const MaxSize = 1 << 16
+
+// Pool is a concurrency-safe set of fake address pools, at most one per
+// address family.
+type Pool struct {
+	mu     sync.Mutex // guards the fields below
+	v4, v6 *family
+}
+
+// family is the pool of one address family.
+type family struct {
+	prefix netip.Prefix
+	size   uint64
+	byName map[string]*list.Element
+	byAddr map[netip.Addr]*list.Element
+	lru    *list.List // of *entry, front is most recently used
+}
+
+type entry struct {
+	name string
+	addr netip.Addr
+}
+
+// New returns a pool of the addresses in cidrs, at most one IPv4 and one IPv6
+// CIDR.
+func New(cidrs []string) (*Pool, error) {
+	p := &Pool{}
+	for _, s := range cidrs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefix = prefix.Masked()
+		f := &family{
+			prefix: prefix,
+			byName: map[string]*list.Element{},
+			byAddr: map[netip.Addr]*list.Element{},
+			lru:    list.New(),
+		}
+		f.size = MaxSize
+		if bits := prefix.Addr().BitLen() - prefix.Bits(); bits <= 16 {
+			// leave out the network and, for IPv4, the broadcast address
+			f.size = 1<<bits - 1
+			if prefix.Addr().Is4() && f.size > 0 {
+				f.size--
+			}
+		}
+		if f.size == 0 {
+			return nil, fmt.Errorf("fake address pool %s is too small", s)
+		}
+		fp := &p.v6
+		if prefix.Addr().Is4() {
+			fp = &p.v4
+		}
+		if *fp != nil {
+			return nil, fmt.Errorf("more than one fake address pool of the family of %s", s)
+		}
+		*fp = f
+	}
+	return p, nil
+}
+
+// Prefixes returns the CIDRs of the pool.
+func (p *Pool) Prefixes() (r []netip.Prefix) {
+	for _, f := range []*family{p.v4, p.v6} {
+		if f != nil {
+			r = append(r, f.prefix)
+		}
+	}
+	return
+}
+
+// Contains reports whether a is in the pool.
+func (p *Pool) Contains(a netip.Addr) bool {
+	f := p.family(a.Unmap().Is6())
+	return f != nil && f.prefix.Contains(a.Unmap())
+}
+
+// Addr returns the fake IPv4, or IPv6 if v6, address of name, allocating it if
+// needed. It returns false if the pool has no addresses of the family.
+func (p *Pool) Addr(name string, v6 bool) (netip.Addr, bool) {
+	f := p.family(v6)
+	if f == nil {
+		return netip.Addr{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if el, ok := f.byName[name]; ok {
+		f.lru.MoveToFront(el)
+		return el.Value.(*entry).addr, true
+	}
+	var e *entry
+	if n := uint64(f.lru.Len()); n < f.size {
+		e = &entry{addr: f.addr(n + 1)}
+	} else {
+		// reuse the least recently used address
+		e = f.lru.Remove(f.lru.Back()).(*entry)
+		delete(f.byName, e.name)
+	}
+	e.name = name
+	el := f.lru.PushFront(e)
+	f.byName[name] = el
+	f.byAddr[e.addr] = el
+	return e.addr, true
+}
+
+// Name returns the name the fake address a stands for, false if it is not
+// allocated.
+func (p *Pool) Name(a netip.Addr) (string, bool) {
+	a = a.Unmap()
+	f := p.family(a.Is6())
+	if f == nil {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	el, ok := f.byAddr[a]
+	if !ok {
+		return "", false
+	}
+	f.lru.MoveToFront(el)
+	return el.Value.(*entry).name, true
+}
+
+func (p *Pool) family(v6 bool) *family {
+	if v6 {
+		return p.v6
+	}
+	return p.v4
+}
+
+// addr returns the address at offset n of the pool.
+func (f *family) addr(n uint64) netip.Addr {
+	if f.prefix.Addr().Is4() {
+		b := f.prefix.Addr().As4()
+		binary.BigEndian.PutUint32(b[:], binary.BigEndian.Uint32(b[:])+uint32(n))
+		return netip.AddrFrom4(b)
+	}
+	b := f.prefix.Addr().As16()
+	binary.BigEndian.PutUint64(b[8:], binary.BigEndian.Uint64(b[8:])+n)
+	return netip.AddrFrom16(b)
+}
@@ -0,0 +1,74 @@
+package fakeip
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	p, err := New([]string{"198.18.0.0/15", "fd13:4913:fa6e::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, ok := p.Addr("example.com", false)
+	if !ok || a != netip.MustParseAddr("198.18.0.1") {
+		t.Fatalf("got %s %v, expected the first pool address", a, ok)
+	}
+	if b, _ := p.Addr("example.com", false); b != a {
+		t.Fatalf("got %s for the same name, expected %s", b, a)
+	}
+	a6, ok := p.Addr("example.com", true)
+	if !ok || a6 != netip.MustParseAddr("fd13:4913:fa6e::1") {
+		t.Fatalf("got %s %v, expected the first IPv6 pool address", a6, ok)
+	}
+	b, _ := p.Addr("example.org", false)
+	if b != netip.MustParseAddr("198.18.0.2") {
+		t.Fatalf("got %s, expected the next pool address", b)
+	}
+	for _, tc := range []struct {
+		addr string
+		name string
+		ok   bool
+	}{
+		{"198.18.0.1", "example.com", true},
+		{"::ffff:198.18.0.2", "example.org", true},
+		{"fd13:4913:fa6e::1", "example.com", true},
+		{"198.18.0.3", "", false},
+		{"10.0.0.1", "", false},
+	} {
+		if name, ok := p.Name(netip.MustParseAddr(tc.addr)); name != tc.name || ok != tc.ok {
+			t.Errorf("%s: got %q %v, expected %q %v", tc.addr, name, ok, tc.name, tc.ok)
+		}
+	}
+	if !p.Contains(netip.MustParseAddr("198.19.255.255")) || p.Contains(netip.MustParseAddr("198.20.0.0")) {
+		t.Error("wrong pool membership")
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	p, err := New([]string{"192.0.2.0/30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Addr("a", true); ok {
+		t.Fatal("got an address of a family without pool")
+	}
+	a, _ := p.Addr("a", false)
+	b, _ := p.Addr("b", false)
+	p.Name(a)
+	// b is the least recently used of the 2 usable addresses
+	if c, _ := p.Addr("c", false); c != b {
+		t.Fatalf("got %s, expected reused %s", c, b)
+	}
+	if _, ok := p.Name(a); !ok {
+		t.Fatal("recently used address was reused")
+	}
+	if name, _ := p.Name(b); name != "c" {
+		t.Fatalf("got %q for reused address, expected c", name)
+	}
+	for _, cidrs := range [][]string{{"192.0.2.0/31"}, {"10.0.0.0/8", "192.0.2.0/24"}, {"bogus"}} {
+		if _, err = New(cidrs); err == nil {
+			t.Errorf("%v: expected an error", cidrs)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/M-ERCURY/core/mrnet"
+	"github.com/M-ERCURY/poc/tun/tun"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	nicID = 1
+	// tcp handshakes waiting on their mercury dial
+	maxInFlight = 1024
+	// udp flows are closed after this long without a datagram
+	udpIdle = time.Minute
+)
+
+// flowID is the 5-tuple of a flow terminated by the userspace stack; local is
+// the destination the client connected to.
+type flowID struct {
+	proto string
+	stack.TransportEndpointID
+}
+
+func (f flowID) String() string {
+	src := net.JoinHostPort(f.RemoteAddress.String(), strconv.Itoa(int(f.RemotePort)))
+	return fmt.Sprintf("%s %s -> %s", f.proto, src, f.target())
+}
+
+// target returns the host:port destination of the flow.
+func (f flowID) target() string {
+	return net.JoinHostPort(f.LocalAddress.String(), strconv.Itoa(int(f.LocalPort)))
+}
+
+// netstack reads packets on the tun device into a userspace TCP/IP stack
+// which terminates every tcp and udp flow, whatever its destination, and
+// hands it to mercury's h2c listener at h2caddr. As the circuit doesn't carry
+// ICMP, echo requests are answered locally.
+func netstack(t *tun.T, h2caddr string) error {
+	tt, h2curl := h2ctransport(h2caddr)
+	log.Printf("terminating flows from %s in userspace and proxying via h2c://%s", t.Name(), h2caddr)
+	ep := channel.New(1024, uint32(t.NetIf.MTU), "")
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	if err := s.CreateNIC(nicID, ep); err != nil {
+		return fmt.Errorf("could not create stack NIC: %s", err)
+	}
+	// accept packets to, and send replies from, any address
+	if err := s.SetPromiscuousMode(nicID, true); err != nil {
+		return fmt.Errorf("could not set stack NIC promiscuous: %s", err)
+	}
+	if err := s.SetSpoofing(nicID, true); err != nil {
+		return fmt.Errorf("could not enable stack NIC spoofing: %s", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nicID},
+		{Destination: header.IPv6EmptySubnet, NIC: nicID},
+	})
+	// the client's handshake only completes once the target is dialed, a
+	// failed dial resets it
+	tcpf := tcp.NewForwarder(s, 0, maxInFlight, func(r *tcp.ForwarderRequest) {
+		f := flowID{"tcp", r.ID()}
+		c, err := dialflow(tt, h2curl, "tcp", f.target())
+		if err != nil {
+			log.Printf("error mercury-dialing %s: %s", f, err)
+			r.Complete(true)
+			return
+		}
+		var wq waiter.Queue
+		tep, terr := r.CreateEndpoint(&wq)
+		if terr != nil {
+			log.Printf("error accepting %s: %s", f, terr)
+			c.Close()
+			r.Complete(true)
+			return
+		}
+		r.Complete(false)
+		if err = mrnet.Splice(gonet.NewTCPConn(&wq, tep), c, 0, 32*1024); err != nil && DEBUG {
+			log.Printf("tcp splice of %s terminated: %s", f, err)
+		}
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpf.HandlePacket)
+	udpf := udp.NewForwarder(s, func(r *udp.ForwarderRequest) bool {
+		f := flowID{"udp", r.ID()}
+		var wq waiter.Queue
+		uep, terr := r.CreateEndpoint(&wq)
+		if terr != nil {
+			log.Printf("error accepting %s: %s", f, terr)
+			return false
+		}
+		go udpflow(f, gonet.NewUDPConn(&wq, uep), tt, h2curl)
+		return true
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpf.HandlePacket)
+	// stack -> tun
+	go func() {
+		for {
+			pkt := ep.ReadContext(context.Background())
+			if pkt == nil {
+				return
+			}
+			v := pkt.ToView()
+			if _, err := t.Write(v.AsSlice()); err != nil {
+				log.Printf("could not write packet to tun: %s", err)
+			}
+			v.Release()
+			pkt.DecRef()
+		}
+	}()
+	// tun -> stack
+	go func() {
+		rbuf := make([]byte, 65535)
+		for {
+			n, err := t.Read(rbuf)
+			if err != nil {
+				log.Println("error reading packet data:", err)
+				continue
+			}
+			if r := echoReply(rbuf[:n]); r != nil {
+				if _, err = t.Write(r); err != nil {
+					log.Printf("could not write echo reply to tun: %s", err)
+				}
+				continue
+			}
+			var proto tcpip.NetworkProtocolNumber
+			switch rbuf[0] >> 4 {
+			case 4:
+				proto = header.IPv4ProtocolNumber
+			case 6:
+				proto = header.IPv6ProtocolNumber
+			default:
+				continue
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				Payload: buffer.MakeWithData(rbuf[:n]),
+			})
+			ep.InjectInbound(proto, pkt)
+			pkt.DecRef()
+		}
+	}()
+	return nil
+}
+
+// echoReply returns the reply to an ICMP or ICMPv6 echo request packet, nil
+// if p is not one.
+func echoReply(p []byte) []byte {
+	switch header.IPVersion(p) {
+	case header.IPv4Version:
+		ip := header.IPv4(p)
+		if !ip.IsValid(len(p)) || ip.TransportProtocol() != header.ICMPv4ProtocolNumber || ip.More() || ip.FragmentOffset() != 0 {
+			return nil
+		}
+		ip = append(header.IPv4(nil), p[:ip.TotalLength()]...)
+		h := header.ICMPv4(ip.Payload())
+		src, dst := ip.SourceAddress(), ip.DestinationAddress()
+		if len(h) < header.ICMPv4MinimumSize || h.Type() != header.ICMPv4Echo || header.IsV4MulticastAddress(dst) {
+			return nil
+		}
+		ip.SetSourceAddress(dst)
+		ip.SetDestinationAddress(src)
+		ip.SetTTL(64)
+		ip.SetChecksum(0)
+		ip.SetChecksum(^ip.CalculateChecksum())
+		h.SetType(header.ICMPv4EchoReply)
+		h.SetChecksum(0)
+		h.SetChecksum(^checksum.Checksum(h, 0))
+		return ip
+	case header.IPv6Version:
+		ip := header.IPv6(p)
+		if !ip.IsValid(len(p)) || ip.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return nil
+		}
+		ip = append(header.IPv6(nil), p[:header.IPv6MinimumSize+int(ip.PayloadLength())]...)
+		h := header.ICMPv6(ip.Payload())
+		src, dst := ip.SourceAddress(), ip.DestinationAddress()
+		if len(h) < header.ICMPv6EchoMinimumSize || h.Type() != header.ICMPv6EchoRequest || header.IsV6MulticastAddress(dst) {
+			return nil
+		}
+		ip.SetSourceAddress(dst)
+		ip.SetDestinationAddress(src)
+		ip.SetHopLimit(64)
+		h.SetType(header.ICMPv6EchoReply)
+		h.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: h, Src: dst, Dst: src}))
+		return ip
+	}
+	return nil
+}
+
+// udpflow relays the datagrams of a udp flow through mercury until it is
+// idle for udpIdle.
+func udpflow(f flowID, uc *gonet.UDPConn, tt http.RoundTripper, h2curl string) {
+	defer uc.Close()
+	c, err := dialflow(tt, h2curl, "udp", f.target())
+	if err != nil {
+		log.Printf("error udp mercury-dialing %s: %s", f, err)
+		return
+	}
+	defer c.Close()
+	idle := time.AfterFunc(udpIdle, func() { uc.Close(); c.Close() })
+	defer idle.Stop()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := uc.Read(buf)
+			if err != nil {
+				c.Close()
+				return
+			}
+			idle.Reset(udpIdle)
+			if _, err = c.Write(buf[:n]); err != nil {
+				uc.Close()
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		idle.Reset(udpIdle)
+		if _, err = uc.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
@@ -29,20 +29,24 @@ func getroutes(sh string) (routes []netlink.Route, err error) {
 		return
 	}
 	for _, ip := range ips {
-		if ip.IsLoopback() || ip.IsUnspecified() || ip.To4() == nil {
-			// don't need routes for these... TODO FIXME ipv6
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			// don't need routes for these...
 			continue
 		}
+		family, bits := netlink.FAMILY_V6, net.IPv6len*8
+		if ip.To4() != nil {
+			family, bits = netlink.FAMILY_V4, net.IPv4len*8
+		}
 		var tmp []netlink.Route
-		// get default route(s)
-		if tmp, err = netlink.RouteListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_DST); err != nil {
+		// get default route(s) of the ip's family
+		if tmp, err = netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_DST); err != nil {
 			err = fmt.Errorf("could not get route(s) to %s: %s", ip, err)
 			return
 		}
 		// route bypass ips as default route
 		for _, r := range tmp {
 			if r.Gw != nil {
-				r.Dst = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+				r.Dst = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
 				routes = append(routes, r)
 			}
 		}
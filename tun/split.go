@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/M-ERCURY/poc/clientcfg"
+	"github.com/M-ERCURY/poc/filenames"
+	"github.com/M-ERCURY/poc/tun/split"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// catchall are the networks of all traffic routed into the tun device; they
+// avoid clobbering the default route by being just a _little_ bit more
+// specific
+var catchall = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/1"),   // lower half of all v4 addresses
+	netip.MustParsePrefix("128.0.0.0/1"), // upper half of all v4 addresses
+	netip.MustParsePrefix("2000::/3"),    // v6 global-adressable range
+}
+
+// splitr are the split tunneling rules of tun flows, nil if all go through
+// mercury.
+var splitr atomic.Pointer[split.Rules]
+
+// getsplit reads the split tunneling rules in the config file in sh, leaving
+// their hostnames to resolvesplit.
+func getsplit(sh string) (*split.Rules, error) {
+	p := path.Join(sh, filenames.Config)
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("could not read mercury config file %s: %s", p, err)
+	}
+	var c clientcfg.C
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("could not unmarshal mercury config file %s: %s", p, err)
+	}
+	return split.New(c.Split.Include, c.Split.Exclude)
+}
+
+// resolvesplit resolves the hostnames of the split rules r in the background
+// and sends r to done once they are, as lookups may be slow.
+func resolvesplit(r *split.Rules, done chan<- *split.Rules) {
+	go func() {
+		if err := r.Resolve(lookup); err != nil {
+			log.Print(err)
+		}
+		done <- r
+	}()
+}
+
+// lookup resolves host with the system resolver.
+func lookup(host string) ([]netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// splitroutes returns the routes into the tun device link of the networks r
+// leaves to mercury.
+func splitroutes(link netlink.Link, r *split.Rules) (routes []netlink.Route) {
+	for _, p := range r.Prefixes(catchall) {
+		routes = append(routes, netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen())},
+		})
+	}
+	return
+}
+
+// dialflow dials the ip:port target of a tun flow directly if the split rules
+// exclude it, else through the circuit, by name if it is a fake address. DNS
+// queries intercepted by dnsr are served locally.
+func dialflow(tt http.RoundTripper, h2curl, protocol, target string) (net.Conn, error) {
+	ap, err := netip.ParseAddrPort(target)
+	if err != nil {
+		return nil, err
+	}
+	a := ap.Addr().Unmap()
+	var name string
+	if dnsr != nil && dnsr.pool != nil && dnsr.pool.Contains(a) {
+		var ok bool
+		if name, ok = dnsr.pool.Name(a); !ok {
+			return nil, fmt.Errorf("fake address %s stands for no name", a)
+		}
+	}
+	if !splitr.Load().Tunnel(a, name, ap.Port()) {
+		return dialdirect(protocol, a, name, ap.Port())
+	}
+	switch {
+	case dnsr != nil && ap.Port() == 53:
+		return dnsr.serve(protocol, target), nil
+	case name != "":
+		target = net.JoinHostPort(name, strconv.Itoa(int(ap.Port())))
+	}
+	return dial(tt, h2curl, protocol, target)
+}
+
+// dialdirect dials a flow to a:port the split rules exclude, bound to the
+// interface of the default route so that it doesn't loop back into the tun
+// device. Fake addresses are dialed to an address of the name they stand for.
+func dialdirect(protocol string, a netip.Addr, name string, port uint16) (net.Conn, error) {
+	if name != "" {
+		addrs, err := dnsr.lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve %s: %s", name, err)
+		}
+		a = addrs[0].Unmap()
+	}
+	ifname, err := uplink(a.Is6())
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.BindToDevice(int(fd), ifname)
+			}); cerr != nil {
+				return cerr
+			}
+			return
+		},
+	}
+	return d.Dial(protocol, netip.AddrPortFrom(a, port).String())
+}
+
+// uplink returns the name of the interface of the IPv4, or IPv6 if v6, default
+// route.
+func uplink(v6 bool) (string, error) {
+	family := netlink.FAMILY_V4
+	if v6 {
+		family = netlink.FAMILY_V6
+	}
+	routes, err := netlink.RouteListFiltered(family, filter, netlink.RT_FILTER_DST)
+	if err != nil {
+		return "", fmt.Errorf("could not get default route: %s", err)
+	}
+	for _, r := range routes {
+		if r.Gw != nil {
+			link, err := netlink.LinkByIndex(r.LinkIndex)
+			if err != nil {
+				return "", fmt.Errorf("could not get link of default route: %s", err)
+			}
+			return link.Attrs().Name, nil
+		}
+	}
+	return "", errors.New("no default route")
+}
@@ -0,0 +1,301 @@
+// Package split decides which of the traffic routed into mercury_tun goes
+// through mercury and which goes direct, from include and exclude rules.
+package split
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Rules are split tunneling rules. A nil *Rules sends everything through
+// mercury.
+type Rules struct {
+	include, exclude []*rule
+	// whether the include list is set, even if empty
+	includes bool
+
+	mu sync.RWMutex // guards the addrs of the rules
+}
+
+// rule is a "HOST[:PORTS]" rule: HOST is *, an IP address, a CIDR, a hostname
+// or a *.domain wildcard, PORTS a port or a low-high range; IPv6 addresses
+// with ports are bracketed.
+type rule struct {
+	raw string
+	// network, if HOST is an IP address or CIDR
+	prefix netip.Prefix
+	// hostname, *.domain wildcard or "*" for any host
+	host string
+	// port range, 0-65535 for any
+	lo, hi uint16
+	// resolved addresses of a hostname
+	addrs []netip.Addr
+}
+
+// New parses the include and exclude rules, either of which may be nil. It
+// returns nil if both are.
+func New(include, exclude *[]string) (*Rules, error) {
+	if include == nil && exclude == nil {
+		return nil, nil
+	}
+	r := &Rules{includes: include != nil}
+	for _, l := range []struct {
+		rules *[]string
+		r     *[]*rule
+	}{{include, &r.include}, {exclude, &r.exclude}} {
+		if l.rules == nil {
+			continue
+		}
+		for _, s := range *l.rules {
+			x, err := parse(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid split rule %q: %w", s, err)
+			}
+			*l.r = append(*l.r, x)
+		}
+	}
+	return r, nil
+}
+
+// parse parses a HOST[:PORTS] rule.
+func parse(s string) (*rule, error) {
+	x := &rule{raw: s, hi: 0xffff}
+	host, ports, sep := s, "", false
+	switch {
+	case strings.HasPrefix(s, "["):
+		i := strings.Index(s, "]")
+		if i < 0 {
+			return nil, errors.New("missing ]")
+		}
+		host, ports = s[1:i], s[i+1:]
+		if ports != "" {
+			if ports[0] != ':' {
+				return nil, errors.New("expected :PORTS after ]")
+			}
+			ports, sep = ports[1:], true
+		}
+	case strings.Count(s, ":") == 1:
+		i := strings.IndexByte(s, ':')
+		host, ports, sep = s[:i], s[i+1:], true
+	}
+	if sep {
+		lo, hi := ports, ports
+		if i := strings.IndexByte(ports, '-'); i >= 0 {
+			lo, hi = ports[:i], ports[i+1:]
+		}
+		l, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", lo)
+		}
+		h, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", hi)
+		}
+		if l > h {
+			return nil, fmt.Errorf("invalid port range %q", ports)
+		}
+		x.lo, x.hi = uint16(l), uint16(h)
+	}
+	switch {
+	case host == "":
+		return nil, errors.New("empty host")
+	case host == "*":
+		x.host = host
+	case strings.Contains(host, "/"):
+		p, err := netip.ParsePrefix(host)
+		if err != nil {
+			return nil, err
+		}
+		x.prefix = p.Masked()
+	default:
+		if a, err := netip.ParseAddr(host); err == nil {
+			x.prefix = netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen())
+			break
+		}
+		x.host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if strings.Contains(strings.TrimPrefix(x.host, "*."), "*") {
+			return nil, errors.New("wildcards are only allowed as *.domain")
+		}
+	}
+	return x, nil
+}
+
+// allports reports whether the rule matches any port.
+func (x *rule) allports() bool { return x.lo == 0 && x.hi == 0xffff }
+
+// matchName reports whether the rule matches hostname name.
+func (x *rule) matchName(name string) bool {
+	switch {
+	case name == "" || x.host == "":
+		return false
+	case x.host == "*":
+		return true
+	case strings.HasPrefix(x.host, "*."):
+		return strings.HasSuffix(name, x.host[1:])
+	}
+	return name == x.host
+}
+
+// match reports whether rule x matches a flow to address a, standing for
+// hostname name if not empty, and port.
+func (r *Rules) match(x *rule, a netip.Addr, name string, port uint16) bool {
+	if port < x.lo || port > x.hi {
+		return false
+	}
+	switch {
+	case x.host == "*":
+		return true
+	case x.prefix.IsValid():
+		return x.prefix.Contains(a.Unmap())
+	case x.matchName(name):
+		return true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, b := range x.addrs {
+		if b == a.Unmap() {
+			return true
+		}
+	}
+	return false
+}
+
+// Tunnel reports whether a flow to address a, standing for hostname name if
+// not empty, and port goes through mercury: it must match no exclude rule
+// and, if the include list is set, an include rule.
+func (r *Rules) Tunnel(a netip.Addr, name string, port uint16) bool {
+	if r == nil {
+		return true
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, x := range r.exclude {
+		if r.match(x, a, name, port) {
+			return false
+		}
+	}
+	if !r.includes {
+		return true
+	}
+	for _, x := range r.include {
+		if r.match(x, a, name, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// TunnelName reports whether flows to hostname name may go through mercury,
+// judging by the hostname rules only: it must match no exclude rule for any
+// port and, if the include list is set, an include rule.
+func (r *Rules) TunnelName(name string) bool {
+	if r == nil {
+		return true
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, x := range r.exclude {
+		if x.allports() && x.matchName(name) {
+			return false
+		}
+	}
+	if !r.includes {
+		return true
+	}
+	for _, x := range r.include {
+		if x.matchName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve sets the addresses of the hostname rules to those lookup returns,
+// keeping the previous ones of the hostnames it fails for. Wildcard rules
+// only match the hostnames of fake address flows.
+func (r *Rules) Resolve(lookup func(host string) ([]netip.Addr, error)) (err error) {
+	if r == nil {
+		return nil
+	}
+	for _, x := range append(r.include[:len(r.include):len(r.include)], r.exclude...) {
+		if x.host == "" || strings.HasPrefix(x.host, "*") {
+			continue
+		}
+		addrs, lerr := lookup(x.host)
+		if lerr != nil {
+			err = errors.Join(err, fmt.Errorf("could not resolve split rule %q: %w", x.raw, lerr))
+			continue
+		}
+		for i, a := range addrs {
+			addrs[i] = a.Unmap()
+		}
+		r.mu.Lock()
+		x.addrs = addrs
+		r.mu.Unlock()
+	}
+	return
+}
+
+// Prefixes returns the networks of catchall, the routes of all traffic into
+// mercury_tun, which are to be routed into it: those of the include rules, if
+// the include list is set, less those of the exclude rules for any port.
+// Rules with ports are left to Tunnel.
+func (r *Rules) Prefixes(catchall []netip.Prefix) []netip.Prefix {
+	if r == nil {
+		return catchall
+	}
+	ps := catchall
+	if r.includes {
+		ps = nil
+		for _, x := range r.include {
+			ps = append(ps, r.prefixes(x, catchall)...)
+		}
+	}
+	for _, x := range r.exclude {
+		if !x.allports() {
+			continue
+		}
+		for _, p := range r.prefixes(x, catchall) {
+			ps = subtract(ps, p)
+		}
+	}
+	return ps
+}
+
+// prefixes returns the networks rule x matches.
+func (r *Rules) prefixes(x *rule, catchall []netip.Prefix) (ps []netip.Prefix) {
+	switch {
+	case x.host == "*":
+		return catchall
+	case x.prefix.IsValid():
+		return []netip.Prefix{x.prefix}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, a := range x.addrs {
+		ps = append(ps, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return
+}
+
+// subtract returns the networks of ps less those of ex.
+func subtract(ps []netip.Prefix, ex netip.Prefix) (r []netip.Prefix) {
+	for _, p := range ps {
+		switch {
+		case !p.Overlaps(ex):
+			r = append(r, p)
+		case ex.Bits() <= p.Bits():
+			// p is within ex
+		default:
+			// split p in halves until ex is one of them
+			lo := netip.PrefixFrom(p.Addr(), p.Bits()+1)
+			b := p.Addr().AsSlice()
+			b[p.Bits()/8] |= 0x80 >> (p.Bits() % 8)
+			hi, _ := netip.AddrFromSlice(b)
+			r = append(r, subtract([]netip.Prefix{lo, netip.PrefixFrom(hi, p.Bits()+1)}, ex)...)
+		}
+	}
+	return
+}
@@ -0,0 +1,130 @@
+package split
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+var catchall = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/1"),
+	netip.MustParsePrefix("128.0.0.0/1"),
+	netip.MustParsePrefix("2000::/3"),
+}
+
+func TestTunnel(t *testing.T) {
+	r, err := New(nil, &[]string{"10.0.0.0/8", "192.0.2.1:22", "*:5000-5999", "[2001:db8::1]:443", "intranet.example.com", "*.corp.example.com:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Resolve(func(host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("203.0.113.7")}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addr string
+		name string
+		port uint16
+		want bool
+	}{
+		{"10.1.2.3", "", 443, false},
+		{"192.0.2.1", "", 22, false},
+		{"192.0.2.1", "", 23, true},
+		{"8.8.8.8", "", 5353, false},
+		{"2001:db8::1", "", 443, false},
+		{"2001:db8::1", "", 80, true},
+		{"203.0.113.7", "", 80, false},
+		{"198.18.0.1", "Intranet.Example.com.", 80, false},
+		{"198.18.0.2", "git.corp.example.com", 80, false},
+		{"198.18.0.2", "git.corp.example.com", 443, true},
+		{"198.18.0.3", "example.com", 80, true},
+	} {
+		if got := r.Tunnel(netip.MustParseAddr(tc.addr), tc.name, tc.port); got != tc.want {
+			t.Errorf("%s %q %d: got %v, expected %v", tc.addr, tc.name, tc.port, got, tc.want)
+		}
+	}
+	if r.TunnelName("intranet.example.com") || !r.TunnelName("git.corp.example.com") {
+		t.Error("wrong hostname rules")
+	}
+	var nilr *Rules
+	if !nilr.Tunnel(netip.MustParseAddr("10.0.0.1"), "", 80) || !nilr.TunnelName("example.com") {
+		t.Error("nil rules don't tunnel everything")
+	}
+}
+
+func TestInclude(t *testing.T) {
+	r, err := New(&[]string{"203.0.113.0/24", "*.example.com"}, &[]string{"203.0.113.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		addr string
+		name string
+		want bool
+	}{
+		{"203.0.113.1", "", true},
+		{"203.0.113.5", "", false},
+		{"198.51.100.1", "", false},
+		{"198.18.0.1", "www.example.com", true},
+		{"198.18.0.2", "example.org", false},
+	} {
+		if got := r.Tunnel(netip.MustParseAddr(tc.addr), tc.name, 443); got != tc.want {
+			t.Errorf("%s %q: got %v, expected %v", tc.addr, tc.name, got, tc.want)
+		}
+	}
+	if !r.TunnelName("www.example.com") || r.TunnelName("example.org") {
+		t.Error("wrong hostname rules")
+	}
+	got := fmt.Sprint(r.Prefixes(catchall))
+	if want := "[203.0.113.0/30 203.0.113.4/32 203.0.113.6/31 203.0.113.8/29 203.0.113.16/28 203.0.113.32/27 203.0.113.64/26 203.0.113.128/25]"; got != want {
+		t.Errorf("got prefixes %s, expected %s", got, want)
+	}
+}
+
+func TestPrefixes(t *testing.T) {
+	r, err := New(nil, &[]string{"128.0.0.0/2", "192.0.2.1:22", "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Resolve(func(host string) ([]netip.Addr, error) { return nil, errors.New("no such host") })
+	if err == nil {
+		t.Fatal("expected a resolution error")
+	}
+	got := fmt.Sprint(r.Prefixes(catchall))
+	if want := "[0.0.0.0/1 192.0.0.0/2 2000::/3]"; got != want {
+		t.Errorf("got prefixes %s, expected %s", got, want)
+	}
+	r.Resolve(func(host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("2001:db8::")}, nil
+	})
+	// 2000::/3 less one address is split in 125 prefixes
+	ps := r.Prefixes(catchall)
+	if len(ps) != 2+125 {
+		t.Errorf("got %d prefixes, expected 127", len(ps))
+	}
+	for _, p := range ps {
+		if p.Contains(netip.MustParseAddr("2001:db8::")) {
+			t.Errorf("resolved address left in %s", p)
+		}
+	}
+	if r, _ = New(nil, &[]string{"*"}); len(r.Prefixes(catchall)) != 0 {
+		t.Error("excluding everything left routes")
+	}
+	if r, _ = New(&[]string{}, nil); len(r.Prefixes(catchall)) != 0 {
+		t.Error("including nothing left routes")
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"", ":80", "10.0.0.0/33", "example.com:80-22", "example.com:http", "[::1", "[::1]80", "a.*.example.com"} {
+		if _, err := New(&[]string{s}, nil); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+	if r, err := New(nil, nil); r != nil || err != nil {
+		t.Errorf("got %v %v, expected no rules", r, err)
+	}
+}
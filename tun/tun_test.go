@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/M-ERCURY/poc/clientlib"
+	"github.com/M-ERCURY/poc/tun/fakeip"
+	"github.com/M-ERCURY/poc/tun/split"
+	"github.com/M-ERCURY/poc/tun/tun"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+)
+
+// netnsEnv is set in test processes running in their own network namespace.
+const netnsEnv = "MERCURY_TUN_TEST_NETNS"
+
+// netnsTest runs the rest of the test in a new network namespace, skipping it
+// if that is not possible. Only the test's goroutine is in it, unless the
+// process is.
+func netnsTest(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces require root")
+	}
+	if os.Getenv(netnsEnv) != "" {
+		return
+	}
+	runtime.LockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Skipf("could not get network namespace: %s", err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		orig.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("could not create network namespace: %s", err)
+	}
+	t.Cleanup(func() {
+		netns.Set(orig)
+		ns.Close()
+		orig.Close()
+		runtime.UnlockOSThread()
+	})
+}
+
+// newUplink returns a tun device with the default routes, via 192.0.2.1 and
+// 2001:db8:1::1.
+func newUplink(t *testing.T) *tun.T {
+	up, err := tun.New()
+	if err != nil {
+		t.Skipf("could not create tun device: %s", err)
+	}
+	t.Cleanup(func() { up.Close() })
+	link, err := netlink.LinkByName(up.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []string{"192.0.2.2/24", "2001:db8:1::2/64"} {
+		addr, _ := netlink.ParseAddr(a)
+		addr.Flags = unix.IFA_F_NODAD
+		if err = netlink.AddrAdd(link, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, gw := range []string{"192.0.2.1", "2001:db8:1::1"} {
+		if err = netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP(gw)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return up
+}
+
+func TestGetroutes(t *testing.T) {
+	netnsTest(t)
+	newUplink(t)
+	sh := t.TempDir()
+	bypass := `["198.51.100.1", "2001:db8:5::5", "127.0.0.1", "::1", "::"]`
+	if err := os.WriteFile(path.Join(sh, "bypass.json"), []byte(bypass), 0644); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := getroutes(sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"198.51.100.1/32": "192.0.2.1", "2001:db8:5::5/128": "2001:db8:1::1"}
+	for _, r := range routes {
+		if gw, ok := want[r.Dst.String()]; !ok || !r.Gw.Equal(net.ParseIP(gw)) {
+			t.Errorf("unexpected bypass route %s", r)
+		}
+		delete(want, r.Dst.String())
+	}
+	for dst, gw := range want {
+		t.Errorf("no bypass route to %s via %s", dst, gw)
+	}
+}
+
+// stacks are the flow termination modes of mercury_tun.
+var stacks = []struct {
+	name  string
+	start func(*tun.T, string) error
+}{
+	{"netstack", netstack},
+	{"nat", func(tn *tun.T, h2caddr string) error { return tunsplice(tn, h2caddr, "10.13.49.0:13493") }},
+}
+
+// tunTest runs the rest of the test in a new network namespace, with a tun
+// device set up like mercury_tun does and forwarding flows with start to a h2c
+// listener dialing with dialer.
+func tunTest(t *testing.T, start func(*tun.T, string) error, dialer clientlib.DialFunc) {
+	netnsTest(t)
+	// a unix socket is reachable from threads outside the namespace
+	h2caddr := clientlib.UnixPrefix + path.Join(t.TempDir(), "h2c.sock")
+	if err := clientlib.ListenH2C(h2caddr, nil, nil, nil, dialer, nil); err != nil {
+		t.Fatal(err)
+	}
+	tn, err := tun.New()
+	if err != nil {
+		t.Skipf("could not create tun device: %s", err)
+	}
+	link, err := netlink.LinkByName(tn.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []string{"10.13.49.0/31", "fd13:4913::/127"} {
+		addr, _ := netlink.ParseAddr(a)
+		if err = netlink.AddrAdd(link, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, cidr := range []string{"198.18.0.0/15", "2000::/3"} {
+		_, dst, _ := net.ParseCIDR(cidr)
+		if err = netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = start(tn, h2caddr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// echoDialer returns a dialer echoing every target and recording it in
+// targets.
+func echoDialer(mu *sync.Mutex, targets map[string]bool) clientlib.DialFunc {
+	return func(ctx context.Context, protocol, target string) (net.Conn, error) {
+		mu.Lock()
+		targets[protocol+" "+target] = true
+		mu.Unlock()
+		c1, c2 := net.Pipe()
+		go func() { io.Copy(c2, c2); c2.Close() }()
+		return c1, nil
+	}
+}
+
+// ping writes to a new connection to addr and checks it is echoed.
+func ping(t *testing.T, network, addr string) {
+	c, err := net.DialTimeout(network, addr, 3*time.Second)
+	if err != nil {
+		t.Fatalf("%s %s: %s", network, addr, err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+	b := make([]byte, 4)
+	if _, err = c.Write([]byte("ping")); err == nil {
+		_, err = io.ReadFull(c, b)
+	}
+	if err != nil || string(b) != "ping" {
+		t.Fatalf("%s %s: got %q, %v", network, addr, b, err)
+	}
+}
+
+func TestForward6(t *testing.T) {
+	for _, s := range stacks {
+		t.Run(s.name, func(t *testing.T) {
+			var (
+				mu      sync.Mutex
+				targets = map[string]bool{}
+			)
+			tunTest(t, s.start, echoDialer(&mu, targets))
+			for _, d := range []string{"tcp [2001:db8::1]:80", "udp [2001:db8::2]:53"} {
+				ping(t, d[:3], d[4:])
+				mu.Lock()
+				ok := targets[d]
+				mu.Unlock()
+				if !ok {
+					t.Fatalf("%s: not dialed through h2c, got %v", d, targets)
+				}
+			}
+		})
+	}
+}
+
+func TestSlowUDPDial(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		targets = map[string]bool{}
+		echo    = echoDialer(&mu, targets)
+		release = make(chan struct{})
+	)
+	// udp dials hang until the test is done
+	tunTest(t, stacks[1].start, func(ctx context.Context, protocol, target string) (net.Conn, error) {
+		if protocol == "udp" {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return echo(ctx, protocol, target)
+	})
+	defer close(release)
+	c, err := net.Dial("udp", "[2001:db8::2]:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the second datagram is queued while the flow is dialed
+	for i := 0; i < 2; i++ {
+		if _, err = c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	ping(t, "tcp", "[2001:db8::1]:80")
+}
+
+// netnsProcess runs the test in a new test process in its own network
+// namespace, for tests of goroutines other than the test's, and returns
+// whether the caller is that process.
+func netnsProcess(t *testing.T) bool {
+	if os.Getenv(netnsEnv) != "" {
+		return true
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces require root")
+	}
+	run := "^" + strings.Join(strings.Split(t.Name(), "/"), "$/^") + "$"
+	cmd := exec.Command(os.Args[0], "-test.run="+run, "-test.v")
+	cmd.Env = append(os.Environ(), netnsEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	out, err := cmd.CombinedOutput()
+	switch {
+	case err != nil:
+		t.Fatalf("%s\n%s", err, out)
+	case bytes.Contains(out, []byte("--- SKIP")):
+		t.Skipf("%s", out)
+	}
+	return false
+}
+
+func TestSplit(t *testing.T) {
+	for _, s := range stacks {
+		t.Run(s.name, func(t *testing.T) {
+			// direct dials happen on other goroutines
+			if !netnsProcess(t) {
+				return
+			}
+			var (
+				mu      sync.Mutex
+				targets = map[string]bool{}
+			)
+			tunTest(t, s.start, echoDialer(&mu, targets))
+			up := newUplink(t)
+			rules, err := split.New(nil, &[]string{"[2001:db8::1]:80"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			splitr.Store(rules)
+			t.Cleanup(func() { splitr.Store(nil) })
+			ping(t, "tcp", "[2001:db8::1]:443")
+			// the excluded flow is dialed directly, through the uplink
+			syn := make(chan error, 1)
+			go func() {
+				for {
+					data, _, err := up.ReadPacketData()
+					if err != nil {
+						syn <- err
+						return
+					}
+					p := gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default)
+					ip, _ := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+					tcp, _ := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+					if ip != nil && tcp != nil && tcp.SYN && tcp.DstPort == 80 && ip.DstIP.Equal(net.ParseIP("2001:db8::1")) {
+						syn <- nil
+						return
+					}
+				}
+			}()
+			if c, err := net.DialTimeout("tcp", "[2001:db8::1]:80", time.Second); err == nil {
+				c.Close()
+			}
+			select {
+			case err := <-syn:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("excluded flow not dialed through the uplink")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if targets["tcp [2001:db8::1]:80"] {
+				t.Fatal("excluded flow dialed through h2c")
+			}
+		})
+	}
+}
+
+func TestDNS(t *testing.T) {
+	for _, s := range stacks {
+		t.Run(s.name, func(t *testing.T) {
+			var (
+				mu      sync.Mutex
+				targets = map[string]bool{}
+				echo    = echoDialer(&mu, targets)
+				// upstream connections dialed
+				upstreams int
+			)
+			// the upstream resolver answers TXT queries over tcp
+			dialer := func(ctx context.Context, protocol, target string) (net.Conn, error) {
+				if protocol+" "+target != "tcp 1.1.1.1:53" {
+					return echo(ctx, protocol, target)
+				}
+				mu.Lock()
+				upstreams++
+				mu.Unlock()
+				c1, c2 := net.Pipe()
+				go func() {
+					defer c2.Close()
+					for {
+						q, err := readmsg(c2)
+						if err != nil {
+							return
+						}
+						var p dnsmessage.Parser
+						h, _ := p.Start(q)
+						question, _ := p.Question()
+						b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true})
+						b.StartQuestions()
+						b.Question(question)
+						b.StartAnswers()
+						b.TXTResource(dnsmessage.ResourceHeader{Name: question.Name, Class: question.Class}, dnsmessage.TXTResource{TXT: []string{"upstream"}})
+						m, _ := b.Finish()
+						c2.Write(frame(m))
+					}
+				}()
+				return c1, nil
+			}
+			pool, err := fakeip.New([]string{"198.18.0.0/15"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tunTest(t, func(tn *tun.T, h2caddr string) error {
+				dnsr = newResolver(h2caddr, "1.1.1.1:53", pool)
+				return s.start(tn, h2caddr)
+			}, dialer)
+			t.Cleanup(func() { dnsr = nil })
+			for _, network := range []string{"udp", "tcp"} {
+				// queries to the tun's peer address
+				m := query(t, network, "10.13.49.1:53", "Example.com.", dnsmessage.TypeA)
+				if len(m.Answers) != 1 || m.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{198, 18, 0, 1} {
+					t.Fatalf("%s: got %+v, expected the first fake address", network, m)
+				}
+				m = query(t, network, "10.13.49.1:53", "example.com.", dnsmessage.TypeAAAA)
+				if m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 0 {
+					t.Fatalf("%s: got %+v, expected no IPv6 fake address", network, m)
+				}
+				m = query(t, network, "10.13.49.1:53", "example.com.", dnsmessage.TypeTXT)
+				if len(m.Answers) != 1 || m.Answers[0].Body.(*dnsmessage.TXTResource).TXT[0] != "upstream" {
+					t.Fatalf("%s: got %+v, expected the upstream answer", network, m)
+				}
+			}
+			ping(t, "tcp", "198.18.0.1:443")
+			mu.Lock()
+			defer mu.Unlock()
+			if !targets["tcp example.com:443"] {
+				t.Fatalf("fake address not dialed by name, got %v", targets)
+			}
+			if upstreams != 1 {
+				t.Fatalf("upstream dialed %d times, expected queries pipelined on 1 connection", upstreams)
+			}
+		})
+	}
+}
+
+func TestDNSSlowDial(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		dials   = map[string]int{}
+		release = make(chan struct{})
+	)
+	// upstreams echo queries, dials to 192.0.2.1 hang until released
+	r := &resolver{
+		dial: func(protocol, target string) (net.Conn, error) {
+			mu.Lock()
+			dials[target]++
+			mu.Unlock()
+			if target == "192.0.2.1:53" {
+				<-release
+			}
+			c1, c2 := net.Pipe()
+			go func() {
+				defer c2.Close()
+				for {
+					q, err := readmsg(c2)
+					if err != nil {
+						return
+					}
+					c2.Write(frame(q))
+				}
+			}()
+			return c1, nil
+		},
+		conns: map[string]*dnsconn{},
+	}
+	q := make([]byte, 12)
+	res := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := r.exchange("192.0.2.1:53", q)
+			res <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.exchange("192.0.2.2:53", q)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("query held up by a dial to another server")
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-res; err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if dials["192.0.2.1:53"] != 1 {
+		t.Fatalf("slow upstream dialed %d times, expected queries to wait on 1 dial", dials["192.0.2.1:53"])
+	}
+}
+
+// query sends a DNS query to server over udp or tcp and returns its answer.
+func query(t *testing.T, network, server, name string, qtype dnsmessage.Type) (m dnsmessage.Message) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 4913, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.DialTimeout(network, server, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+	var a []byte
+	if network == "udp" {
+		if _, err = c.Write(q); err == nil {
+			a = make([]byte, 65535)
+			var n int
+			n, err = c.Read(a)
+			a = a[:n]
+		}
+	} else if _, err = c.Write(frame(q)); err == nil {
+		a, err = readmsg(c)
+	}
+	if err == nil {
+		err = m.Unpack(a)
+	}
+	if err != nil || m.ID != 4913 {
+		t.Fatalf("%s %s %s: %v %+v", network, name, qtype, err, m.Header)
+	}
+	return
+}
@@ -6,53 +6,130 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/netip"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/M-ERCURY/core/api/status"
 	"github.com/M-ERCURY/core/mrnet/h2conn"
-	"github.com/M-ERCURY/poc/tun/ptable"
+	"github.com/M-ERCURY/poc/tun/conntrack"
 	"github.com/M-ERCURY/poc/tun/tun"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"golang.org/x/net/http2"
 )
 
-var pt = &ptable.T{}
+var ct = conntrack.New(conntrack.DefaultMax)
 var DEBUG = false
 
-// spliceconn copies one accepted TCP connection's i/o to the stored connection
-// for this port table entry.
+func init() {
+	// served with the profiles if MERCURY_TUN_PPROF is set
+	http.HandleFunc("/debug/conntrack", func(w http.ResponseWriter, r *http.Request) {
+		ct.Dump(w)
+	})
+}
+
+// spliceconn copies one accepted TCP connection's i/o to the connection of the
+// flow NATed to its source port.
 func spliceconn(c net.Conn) {
 	defer c.Close()
 	p := c.RemoteAddr().(*net.TCPAddr).Port
-	pe := pt.Get(ptable.TCP, p)
-	if pe == nil {
+	f := ct.Lookup(conntrack.TCP, uint16(p))
+	if f == nil {
 		if DEBUG {
-			log.Printf("no destination known for source port %d, ignoring", p)
+			log.Printf("no destination known for nat port %d, ignoring", p)
 		}
 		return
 	}
 	// wait on available connection
-	pe.Lock()
-	defer pe.Unlock()
-	if pe.Conn == nil {
+	cc := f.Wait()
+	if cc == nil {
 		if DEBUG {
-			log.Printf("no connection found for source port %d, ignoring", p)
+			log.Printf("no connection found for %s, ignoring", f)
 		}
 		return
 	}
 	sync := make(chan error)
-	go func() { _, err := io.Copy(c, pe.Conn); sync <- err }()
-	go func() { _, err := io.Copy(pe.Conn, c); sync <- err }()
+	go func() { _, err := io.Copy(c, cc); sync <- err }()
+	go func() { _, err := io.Copy(cc, c); sync <- err }()
 	e := <-sync // wait until EOF or error
 	c.Close()   // clean up
-	pe.Conn.Close()
+	cc.Close()
 	<-sync // ignore 2nd error, it's caused by close
 	if DEBUG {
 		log.Println("tcp splice terminated, error =", e)
 	}
 }
 
+// h2ctransport returns the h2c transport to mercury's h2c listener at h2caddr
+// and the url to dial with it.
+func h2ctransport(h2caddr string) (http.RoundTripper, string) {
+	// unix:/path h2c sockets are dialed directly, the url host being unused
+	network, address := "tcp", h2caddr
+	if strings.HasPrefix(h2caddr, "unix:") {
+		network, address = "unix", strings.TrimPrefix(h2caddr, "unix:")
+		h2caddr = "unix"
+	}
+	tt := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(_, addr string, cfg *tls.Config) (net.Conn, error) {
+			if network == "unix" {
+				return net.Dial(network, address)
+			}
+			return net.Dial("tcp", addr)
+		},
+	}
+	return tt, "http://" + h2caddr
+}
+
+// statusTransport waits for the response to an h2c dial request, reporting
+// non-200 responses as the dial status sent by mercury.
+type statusTransport struct {
+	http.RoundTripper
+	res chan error
+}
+
+func (t *statusTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := t.RoundTripper.RoundTrip(r)
+	if err == nil && res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		s := &status.T{
+			Code:   res.StatusCode,
+			Desc:   res.Header.Get("Sm-Status-Desc"),
+			Origin: res.Header.Get("Sm-Status-Origin"),
+			Cause:  status.Cause(res.Header.Get("Sm-Status-Cause")),
+		}
+		if s.Desc == "" {
+			s.Desc = http.StatusText(res.StatusCode)
+		}
+		res, err = nil, s
+	}
+	t.res <- err
+	return res, err
+}
+
+// dial dials target through mercury's h2c listener at h2caddr, returning once
+// mercury has answered with the dial status.
+func dial(tt http.RoundTripper, h2caddr, protocol, target string) (net.Conn, error) {
+	st := &statusTransport{RoundTripper: tt, res: make(chan error, 1)}
+	c, err := h2conn.New(st, h2caddr, map[string]string{
+		"Sm-Dial-Protocol": protocol,
+		"Sm-Dial-Target":   target,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = <-st.res; err != nil {
+		// collect the failed round trip before closing
+		c.Read(nil)
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
 // tcpfwd mediates between routed raw packets on the tun device and TCP
 // connections to mercury.
 func tcpfwd(l *net.TCPListener) {
@@ -78,8 +155,39 @@ func copyip(i1 net.IP) (i2 net.IP) {
 	return
 }
 
+// udpwrite writes a datagram of flow f to its connection c, if it could be
+// dialed.
+func udpwrite(f *conntrack.Entry, c net.Conn, p []byte) {
+	if c == nil {
+		return
+	}
+	c.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := c.Write(p); err != nil {
+		log.Printf("error udp writing to %s: %s", f.Dst, err)
+	}
+}
+
+// addrport returns the netip form of an IP and port.
+func addrport(ip net.IP, port uint16) netip.AddrPort {
+	a, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(a.Unmap(), port)
+}
+
+// tcpflags returns the tracked flags of a tcp packet.
+func tcpflags(tcp *layers.TCP) (f conntrack.Flags) {
+	for _, b := range []struct {
+		set  bool
+		flag conntrack.Flags
+	}{{tcp.SYN, conntrack.SYN}, {tcp.ACK, conntrack.ACK}, {tcp.FIN, conntrack.FIN}, {tcp.RST, conntrack.RST}} {
+		if b.set {
+			f |= b.flag
+		}
+	}
+	return
+}
+
 // nextip returns a new IP from the passed one with the last octet incremented
-// by 1. Normally, this should be its /31 "neighbor".
+// by 1. Normally, this should be its /31 or /127 "neighbor".
 func nextip(i1 net.IP) (i2 net.IP) {
 	i2 = copyip(i1)
 	i2[len(i2)-1]++
@@ -87,23 +195,21 @@ func nextip(i1 net.IP) (i2 net.IP) {
 }
 
 // tunsplice reads packets on the tun device and forwards them to mercury in
-// appropriate form.
+// appropriate form, bouncing tcp flows into a kernel socket on the tun address.
+// This is the fallback to netstack.
 func tunsplice(t *tun.T, h2caddr, tunaddr string) error {
 	var (
 		buf  = gopacket.NewSerializeBuffer()
 		opts = gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
 	)
 	log.Printf("capturing packets from %s and proxying via h2c://%s", t.Name(), h2caddr)
-	h2caddr = "http://" + h2caddr
+	tt, h2caddr := h2ctransport(h2caddr)
 	ifaddrs := map[gopacket.LayerType]*net.TCPAddr{}
 	// setup addresses of tunside tcp forwarder
 	addrs, err := t.NetIf.Addrs()
 	if err != nil {
 		return err
 	}
-	if len(addrs) > 2 {
-		return fmt.Errorf("interface %s has more addresses than required, misconfiguration?", t.Name())
-	}
 	_, tunportstr, err := net.SplitHostPort(tunaddr)
 	if err != nil {
 		return fmt.Errorf("could not parse tunaddr `%s`: %s", tunaddr, err)
@@ -113,35 +219,41 @@ func tunsplice(t *tun.T, h2caddr, tunaddr string) error {
 		return fmt.Errorf("could not parse tunaddr port `%s`: %s", tunportstr, err)
 	}
 	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
 			var lt gopacket.LayerType
 			if ipnet.IP.To4() == nil {
 				lt = layers.LayerTypeIPv6
 			} else {
 				lt = layers.LayerTypeIPv4
 			}
+			if ifaddrs[lt] != nil {
+				return fmt.Errorf("interface %s has more addresses than required, misconfiguration?", t.Name())
+			}
 			ifaddrs[lt] = &net.TCPAddr{IP: ipnet.IP, Port: tunport, Zone: t.Name()}
 		}
 	}
-	l4, err := net.ListenTCP("tcp4", ifaddrs[layers.LayerTypeIPv4])
-	if err != nil {
-		return fmt.Errorf("could not listen v4 on %s: %s", ifaddrs[layers.LayerTypeIPv4], err)
-	}
-	log.Printf("listening on tcp4 socket %s", l4.Addr())
-	l6, err := net.ListenTCP("tcp6", ifaddrs[layers.LayerTypeIPv6])
-	if err != nil {
-		return fmt.Errorf("could not listen v6 on %s: %s", ifaddrs[layers.LayerTypeIPv6], err)
+	if ifaddrs[layers.LayerTypeIPv4] == nil {
+		return fmt.Errorf("interface %s has no IPv4 address", t.Name())
 	}
-	log.Printf("listening on tcp6 socket %s", l6.Addr())
-	// h2c-enabled transport
-	tt := &http2.Transport{
-		AllowHTTP: true,
-		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-			return net.Dial(network, addr)
-		},
+	for lt, network := range map[gopacket.LayerType]string{layers.LayerTypeIPv4: "tcp4", layers.LayerTypeIPv6: "tcp6"} {
+		if ifaddrs[lt] == nil {
+			// without an IPv6 address, IPv6 tcp flows are dropped
+			continue
+		}
+		l, err := net.ListenTCP(network, ifaddrs[lt])
+		if err != nil {
+			return fmt.Errorf("could not listen on %s: %s", ifaddrs[lt], err)
+		}
+		log.Printf("listening on %s socket %s", network, l.Addr())
+		go tcpfwd(l)
 	}
-	go tcpfwd(l4)
-	go tcpfwd(l6)
+	go func() {
+		for now := range time.Tick(10 * time.Second) {
+			if n := ct.Expire(now); n > 0 && DEBUG {
+				log.Printf("expired %d idle flows, %d tracked", n, ct.Len())
+			}
+		}
+	}()
 	go func() {
 		var (
 			ip4     layers.IPv4
@@ -196,57 +308,50 @@ func tunsplice(t *tun.T, h2caddr, tunaddr string) error {
 					tcp.SetNetworkLayerForChecksum(ipl)
 
 					lo := ifaddrs[ipl.LayerType()]
-					if !srcip.Equal(lo.IP) {
+					if lo == nil || !srcip.Equal(lo.IP) {
 						// not interested
 						continue
 					}
 					if tcp.SrcPort == layers.TCPPort(lo.Port) {
 						// packet from tcp socket to virtual nexthop
-						if nat := pt.Get(ptable.TCP, int(tcp.DstPort)); nat != nil {
-							// redirect to client
-							*dstip = copyip(lo.IP)
-							*srcip = copyip(nat.DstIP)
-							tcp.SrcPort = layers.TCPPort(nat.DstPort)
-							if tcp.FIN {
-								// clean up finished connection
-								pt.Del(ptable.TCP, int(tcp.DstPort))
-							}
-						} else {
+						f := ct.Lookup(conntrack.TCP, uint16(tcp.DstPort))
+						if f == nil {
 							continue
 						}
+						ct.Track(f, true, tcpflags(&tcp))
+						// redirect to client
+						*dstip = f.Src.Addr().AsSlice()
+						*srcip = f.Dst.Addr().AsSlice()
+						tcp.SrcPort = layers.TCPPort(f.Dst.Port())
+						tcp.DstPort = layers.TCPPort(f.Src.Port())
 					} else {
 						// original packet from client to destination
 						// redirect to tcp socket with spoofed nexthop srcaddr
-						natport := int(tcp.SrcPort)
-						if nat := pt.Get(ptable.TCP, natport); nat == nil {
-							nat = &ptable.Entry{
-								SrcIP:   copyip(*srcip),
-								DstIP:   copyip(*dstip),
-								SrcPort: natport,
-								DstPort: int(tcp.DstPort),
+						// and the flow's nat port
+						k := conntrack.Key{
+							Proto: conntrack.TCP,
+							Src:   addrport(*srcip, uint16(tcp.SrcPort)),
+							Dst:   addrport(*dstip, uint16(tcp.DstPort)),
+						}
+						f := ct.Get(k)
+						if f == nil {
+							if !tcp.SYN || tcp.ACK {
+								// not the start of a flow, e.g. of an expired one
+								continue
 							}
-							pt.Set(ptable.TCP, natport, nat)
-							nat.Lock()
-							dstaddr := net.JoinHostPort(
-								ipl.NetworkFlow().Dst().String(),
-								trl.TransportFlow().Dst().String(),
-							)
+							f = ct.Add(k)
 							go func() {
-								defer nat.Unlock()
-								c, err := h2conn.New(tt, h2caddr, map[string]string{
-									"Sm-Dial-Protocol": "tcp",
-									"Sm-Dial-Target":   dstaddr,
-								})
+								c, err := dialflow(tt, h2caddr, "tcp", f.Dst.String())
 								if err != nil {
-									pt.Del(ptable.TCP, natport)
-									log.Printf("error mercury-dialing %s: %s", dstaddr, err)
-									return
+									log.Printf("error mercury-dialing %s: %s", f.Dst, err)
 								}
-								nat.Conn = c
+								f.SetConn(c)
 							}()
 						}
+						ct.Track(f, false, tcpflags(&tcp))
 						*srcip = nextip(lo.IP)
 						*dstip = copyip(lo.IP)
+						tcp.SrcPort = layers.TCPPort(f.Port)
 						tcp.DstPort = layers.TCPPort(lo.Port)
 					}
 					err = gopacket.SerializeLayers(buf, opts, ipl, trl, gopacket.Payload(tcp.Payload))
@@ -262,42 +367,20 @@ func tunsplice(t *tun.T, h2caddr, tunaddr string) error {
 				case layers.LayerTypeUDP:
 					trl = &udp
 					udp.SetNetworkLayerForChecksum(ipl)
-					natport := int(udp.SrcPort)
-					nat := pt.Get(ptable.UDP, natport)
-					if nat == nil {
-						nat = &ptable.Entry{
-							SrcIP:   copyip(*srcip),
-							DstIP:   copyip(*dstip),
-							SrcPort: natport,
-							DstPort: int(udp.DstPort),
-						}
-						pt.Set(ptable.UDP, natport, nat)
-						// lock while establishing connection
-						nat.Lock()
-						// copy stored variables
-						srcip, dstip, srcport, dstport := copyip(*srcip), copyip(*dstip), udp.SrcPort, udp.DstPort
-						data := make([]byte, len(udp.Payload))
-						copy(data, udp.Payload)
+					k := conntrack.Key{
+						Proto: conntrack.UDP,
+						Src:   addrport(*srcip, uint16(udp.SrcPort)),
+						Dst:   addrport(*dstip, uint16(udp.DstPort)),
+					}
+					f := ct.Get(k)
+					if f == nil {
+						f = ct.Add(k)
 						go func() {
-							defer pt.Del(ptable.UDP, natport)
-							dstaddr := net.JoinHostPort(
-								ipl.NetworkFlow().Dst().String(),
-								trl.TransportFlow().Dst().String(),
-							)
-							c, err := h2conn.New(tt, h2caddr, map[string]string{
-								"Sm-Dial-Protocol": "udp",
-								"Sm-Dial-Target":   dstaddr,
-							})
+							defer ct.Del(f)
+							c, err := dialflow(tt, h2caddr, "udp", f.Dst.String())
+							f.SetConn(c)
 							if err != nil {
-								log.Printf("error udp mercury-dialing %s: %s", dstaddr, err)
-								nat.Unlock()
-								return
-							}
-							nat.Conn = c
-							nat.Unlock()
-							_, err = c.Write(data)
-							if err != nil {
-								log.Printf("error udp writing to %s: %s", dstaddr, err)
+								log.Printf("error udp mercury-dialing %s: %s", f.Dst, err)
 								return
 							}
 							var (
@@ -312,20 +395,20 @@ func tunsplice(t *tun.T, h2caddr, tunaddr string) error {
 								udp  = layers.UDP{}
 							)
 							for {
-								nat.Conn.SetDeadline(time.Now().Add(time.Second * 5))
-								n, err := nat.Conn.Read(rbuf)
+								c.SetDeadline(time.Now().Add(time.Second * 5))
+								n, err := c.Read(rbuf)
 								if err != nil {
 									return
 								}
-								if ip4 := srcip.To4(); ip4 != nil {
-									// v4
-									v4l.SrcIP, v4l.DstIP, nl = dstip, ip4, &v4l
+								ct.Track(f, true, 0)
+								srcip, dstip := f.Dst.Addr().AsSlice(), f.Src.Addr().AsSlice()
+								if f.Src.Addr().Is4() {
+									v4l.SrcIP, v4l.DstIP, nl = srcip, dstip, &v4l
 								} else {
-									// v6
-									v6l.SrcIP, v6l.DstIP, nl = dstip, srcip, &v6l
+									v6l.SrcIP, v6l.DstIP, nl = srcip, dstip, &v6l
 								}
-								udp.SrcPort = layers.UDPPort(dstport)
-								udp.DstPort = layers.UDPPort(srcport)
+								udp.SrcPort = layers.UDPPort(f.Dst.Port())
+								udp.DstPort = layers.UDPPort(f.Src.Port())
 								udp.SetNetworkLayerForChecksum(nl)
 								err = gopacket.SerializeLayers(sbuf, opts, nl, &udp, gopacket.Payload(rbuf[:n]))
 								if err != nil {
@@ -340,16 +423,15 @@ func tunsplice(t *tun.T, h2caddr, tunaddr string) error {
 							}
 						}()
 					}
-					nat.Lock()
-					nat.Unlock()
-					if nat.Conn != nil {
-						nat.Conn.SetDeadline(time.Now().Add(time.Second * 5))
-						_, err = nat.Conn.Write(data)
-						if err != nil {
-							log.Printf("error udp writing to %s: %s", *dstip, err)
-							return
-						}
+					ct.Track(f, false, 0)
+					if c, ok := f.Conn(); ok {
+						udpwrite(f, c, udp.Payload)
+						continue
 					}
+					// queue the datagram until the flow is dialed
+					data := make([]byte, len(udp.Payload))
+					copy(data, udp.Payload)
+					go func() { udpwrite(f, f.Wait(), data) }()
 				}
 			}
 		}